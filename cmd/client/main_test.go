@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	game "github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	pubsub "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	route "github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+type player struct {
+	state  *game.GameState
+	outbox *pubsub.Outbox
+}
+
+// newPlayer subscribes a player's handlers the way main does, on its own
+// connection.
+func newPlayer(ctx context.Context, t *testing.T, b *pubsub.MemoryBroker, username string) *player {
+	t.Helper()
+	conn := b.Connect()
+	t.Cleanup(func() { conn.Close() })
+	publishCh, err := pubsub.NewPublisherPool(conn, pubsub.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := pubsub.OpenOutbox(filepath.Join(t.TempDir(), username+".outbox"), publishCh, pubsub.OutboxOptions{
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	go outbox.Run(ctx)
+
+	ctx = pubsub.WithSender(ctx, username)
+	state := game.NewGameState(username)
+	subscribe := func(sub *pubsub.Subscription, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close() })
+	}
+	subscribe(pubsub.Subscribe(ctx, conn, route.ExchangePerilDirect,
+		route.PauseKey+"."+username,
+		route.PauseKey,
+		pubsub.Transient,
+		handlerPause(state),
+	))
+	subscribe(pubsub.SubscribeDelivery(ctx, conn, route.ExchangePerilTopic,
+		route.ArmyMovesPrefix+"."+username,
+		route.ArmyMovesPrefix+".*",
+		pubsub.Transient,
+		pubsub.HandleErrors(handlerMove(ctx, state, publishCh), reportError),
+	))
+	subscribe(pubsub.SubscribeDelivery(ctx, conn, route.ExchangePerilTopic,
+		route.WarRecognitionsPrefix,
+		route.WarRecognitionsPrefix+".*",
+		pubsub.Quorum,
+		handlerWar(ctx, state, outbox),
+		pubsub.WithMiddleware(pubsub.Deduplicate(pubsub.NewMemoryDedupStore(1000, time.Hour))),
+		pubsub.WithRetry(pubsub.RetryPolicy{Delays: []time.Duration{10 * time.Millisecond}, MaxAttempts: 20}),
+	))
+	return &player{state: state, outbox: outbox}
+}
+
+func (p *player) command(t *testing.T, words ...string) {
+	t.Helper()
+	var err error
+	switch words[0] {
+	case "spawn":
+		err = p.state.CommandSpawn(words)
+	case "move":
+		var mv game.ArmyMove
+		mv, err = p.state.PlanMove(words)
+		if err != nil {
+			break
+		}
+		err = pubsub.Enqueue(context.Background(), p.outbox, route.ExchangePerilTopic,
+			route.ArmyMovesPrefix+"."+p.state.GetUsername(), mv, pubsub.Mandatory())
+		if err == nil {
+			p.state.ApplyMove(mv)
+		}
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(words, " "), err)
+	}
+}
+
+func TestFlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := pubsub.NewMemoryBroker()
+	server := b.Connect()
+	defer server.Close()
+	if err := pubsub.DeclarePerilTopology(ctx, server); err != nil {
+		t.Fatal(err)
+	}
+	serverCh, err := pubsub.NewPublisherPool(server, pubsub.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan route.GameLog, 10)
+	logsSub, err := pubsub.Subscribe(ctx, server, route.ExchangePerilTopic,
+		route.GameLogSlug,
+		route.GameLogSlug+".*",
+		pubsub.Quorum,
+		func(gl route.GameLog) pubsub.AckType {
+			logs <- gl
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logsSub.Close()
+
+	alice := newPlayer(ctx, t, b, "alice")
+	bob := newPlayer(ctx, t, b, "bob")
+	alice.command(t, "spawn", "europe", "infantry")
+	bob.command(t, "spawn", "asia", "artillery")
+
+	setPaused := func(paused bool) {
+		t.Helper()
+		err := pubsub.Publish(ctx, serverCh, route.ExchangePerilDirect, route.PauseKey, route.PlayingState{IsPaused: paused})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []*player{alice, bob} {
+			eventually(t, func() bool {
+				_, err := p.state.PlanMove([]string{"move", "europe", "1"})
+				return (err != nil && strings.Contains(err.Error(), "paused")) == paused
+			})
+		}
+	}
+	setPaused(true)
+	setPaused(false)
+
+	// bob's artillery meets alice's infantry, alice recognises the war and
+	// bob fights it
+	bob.command(t, "move", "europe", "1")
+	select {
+	case gl := <-logs:
+		if gl.Username != "bob" || gl.Message != "{bob} won a war againts {alice}" {
+			t.Errorf("got game log %+v", gl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no game log")
+	}
+	select {
+	case gl := <-logs:
+		t.Errorf("war fought twice: %+v", gl)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if u, ok := bob.state.GetUnit(1); !ok || u.Location != "europe" {
+		t.Errorf("bob's unit: %+v, %v", u, ok)
+	}
+	if u, ok := alice.state.GetUnit(1); !ok || u.Location != "europe" {
+		t.Errorf("alice's unit: %+v, %v", u, ok)
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
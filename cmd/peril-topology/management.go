@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	pubsub "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// management reads a vhost's topology from the RabbitMQ management API.
+type management struct {
+	url      string
+	user     string
+	password string
+	vhost    string
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+func (m *management) topology() (pubsub.Topology, error) {
+	var t pubsub.Topology
+	if err := m.get("exchanges", &t.Exchanges); err != nil {
+		return t, err
+	}
+	if err := m.get("queues", &t.Queues); err != nil {
+		return t, err
+	}
+	if err := m.get("bindings", &t.Bindings); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (m *management) get(resource string, v any) error {
+	u := fmt.Sprintf("%s/api/%s/%s", m.url, resource, url.PathEscape(m.vhost))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(m.user, m.password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", resource, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not list %s: %s", resource, resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("could not decode %s: %w", resource, err)
+	}
+	return nil
+}
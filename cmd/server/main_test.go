@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	pubsub "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	route "github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// newServer subscribes a server's roster the way main does, on its own
+// connection.
+func newServer(ctx context.Context, t *testing.T, b *pubsub.MemoryBroker) *roster {
+	t.Helper()
+	conn := b.Connect()
+	t.Cleanup(func() { conn.Close() })
+	players := newRoster()
+	presenceSub, err := pubsub.Subscribe(ctx, conn, route.ExchangePerilTopic,
+		route.PresencePrefix+".server-"+instanceID(),
+		route.PresencePrefix+".*",
+		pubsub.Transient,
+		players.handlerPresence(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { presenceSub.Close() })
+	onlineSub, err := pubsub.Serve(ctx, conn, route.ExchangePerilDirect,
+		route.OnlinePlayersKey,
+		route.OnlinePlayersKey,
+		pubsub.Durable,
+		players.handlerOnlinePlayers(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { onlineSub.Close() })
+	return players
+}
+
+func TestOnlinePlayers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := pubsub.NewMemoryBroker()
+	client := b.Connect()
+	defer client.Close()
+	if err := pubsub.DeclarePerilTopology(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	// a second server must be able to start alongside the first
+	servers := []*roster{newServer(ctx, t, b), newServer(ctx, t, b)}
+
+	publishCh, err := client.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publishCh.Close()
+	for _, p := range []route.Presence{
+		{Username: "alice", Online: true},
+		{Username: "bob", Online: true},
+		{Username: "bob", Online: false},
+	} {
+		err := pubsub.Publish(ctx, publishCh, route.ExchangePerilTopic, route.PresencePrefix+"."+p.Username, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"alice"}
+	for i, r := range servers {
+		deadline := time.Now().Add(2 * time.Second)
+		for !slices.Equal(r.online(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d has %v online, want %v", i, r.online(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// requests are shared between the servers, each of which can answer
+	for range 4 {
+		reqCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		resp, err := pubsub.Request[route.OnlinePlayersRequest, route.OnlinePlayersResponse](
+			reqCtx, client, route.ExchangePerilDirect, route.OnlinePlayersKey, route.OnlinePlayersRequest{})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(resp.Players, want) {
+			t.Errorf("got %v online, want %v", resp.Players, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	route "github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// roster tracks which players are online from their presence messages. A
+// player that has not been heard from for a few presence intervals is
+// considered gone, in case their client crashed without saying goodbye.
+type roster struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newRoster() *roster {
+	return &roster{lastSeen: map[string]time.Time{}}
+}
+
+func (r *roster) handlerPresence() func(route.Presence) pubsub.AckType {
+	return func(p route.Presence) pubsub.AckType {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if p.Online {
+			r.lastSeen[p.Username] = time.Now()
+		} else {
+			delete(r.lastSeen, p.Username)
+		}
+		return pubsub.Ack
+	}
+}
+
+func (r *roster) online() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-3 * route.PresenceInterval)
+	var players []string
+	for username, seen := range r.lastSeen {
+		if seen.Before(cutoff) {
+			delete(r.lastSeen, username)
+			continue
+		}
+		players = append(players, username)
+	}
+	sort.Strings(players)
+	return players
+}
+
+func (r *roster) handlerOnlinePlayers() func(context.Context, pubsub.Delivery[route.OnlinePlayersRequest]) (route.OnlinePlayersResponse, error) {
+	return func(ctx context.Context, d pubsub.Delivery[route.OnlinePlayersRequest]) (route.OnlinePlayersResponse, error) {
+		players := r.online()
+		fmt.Printf("%s asked who is online: %d players\n", d.Sender, len(players))
+		return route.OnlinePlayersResponse{Players: players}, nil
+	}
+}
@@ -18,6 +18,7 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* online")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
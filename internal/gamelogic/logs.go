@@ -2,7 +2,7 @@ package gamelogic
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -14,7 +14,7 @@ const logsFile = "game.log"
 const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	slog.Info("received game log", "username", gamelog.Username)
 	time.Sleep(writeToDiskSleep)
 
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
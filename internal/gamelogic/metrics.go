@@ -0,0 +1,36 @@
+package gamelogic
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	movesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "game",
+		Name:      "moves_total",
+		Help:      "Moves made by this player.",
+	})
+
+	movesHandledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "game",
+		Name:      "moves_handled_total",
+		Help:      "Moves seen from other players, by MoveOutcome.",
+	}, []string{"outcome"})
+
+	warsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "game",
+		Name:      "wars_total",
+		Help:      "War recognitions handled, by WarOutcome.",
+	}, []string{"outcome"})
+
+	spawnsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "game",
+		Name:      "spawns_total",
+		Help:      "Units spawned, by rank.",
+	}, []string{"rank"})
+)
@@ -3,6 +3,7 @@ package gamelogic
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"strconv"
 )
 
@@ -14,7 +15,28 @@ const (
 	MoveOutcomeMakeWar
 )
 
-func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
+func (o MoveOutcome) String() string {
+	switch o {
+	case MoveOutcomeSamePlayer:
+		return "same-player"
+	case MoveOutComeSafe:
+		return "safe"
+	case MoveOutcomeMakeWar:
+		return "make-war"
+	}
+	return fmt.Sprintf("MoveOutcome(%d)", int(o))
+}
+
+func (gs *GameState) HandleMove(move ArmyMove) (outcome MoveOutcome) {
+	defer func() {
+		slog.Debug("handled move",
+			"username", gs.GetUsername(),
+			"mover", move.Player.Username,
+			"location", move.ToLocation,
+			"units", len(move.Units),
+			"outcome", outcome.String())
+		movesHandledTotal.WithLabelValues(outcome.String()).Inc()
+	}()
 	defer fmt.Println("------------------------")
 	player := gs.GetPlayerSnap()
 
@@ -49,7 +71,19 @@ func getOverlappingLocation(p1 Player, p2 Player) Location {
 	return ""
 }
 
+// CommandMove plans a move and applies it straight away.
 func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+	mv, err := gs.PlanMove(words)
+	if err != nil {
+		return ArmyMove{}, err
+	}
+	gs.ApplyMove(mv)
+	return mv, nil
+}
+
+// PlanMove checks a move command and returns the move it would make,
+// without changing the game state; see ApplyMove.
+func (gs *GameState) PlanMove(words []string) (ArmyMove, error) {
 	if gs.isPaused() {
 		return ArmyMove{}, errors.New("the game is paused, you can not move units")
 	}
@@ -71,22 +105,31 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		unitIDs = append(unitIDs, unitID)
 	}
 
+	// the move carries the player as they will be once it is applied
+	player := gs.GetPlayerSnap()
 	newUnits := []Unit{}
 	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+		unit, ok := player.Units[unitID]
 		if !ok {
 			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
 		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		player.Units[unitID] = unit
 		newUnits = append(newUnits, unit)
 	}
 
-	mv := ArmyMove{
+	return ArmyMove{
 		ToLocation: newLocation,
 		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
+		Player:     player,
+	}, nil
+}
+
+// ApplyMove moves the units of a move planned by PlanMove.
+func (gs *GameState) ApplyMove(mv ArmyMove) {
+	for _, unit := range mv.Units {
+		gs.UpdateUnit(unit)
 	}
+	movesTotal.Inc()
 	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
 }
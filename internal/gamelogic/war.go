@@ -2,6 +2,7 @@ package gamelogic
 
 import (
 	"fmt"
+	"log/slog"
 )
 
 type WarOutcome int
@@ -14,7 +15,50 @@ const (
 	WarOutcomeDraw
 )
 
+func (o WarOutcome) String() string {
+	switch o {
+	case WarOutcomeNotInvolved:
+		return "not-involved"
+	case WarOutcomeNoUnits:
+		return "no-units"
+	case WarOutcomeYouWon:
+		return "you-won"
+	case WarOutcomeOpponentWon:
+		return "opponent-won"
+	case WarOutcomeDraw:
+		return "draw"
+	}
+	return fmt.Sprintf("WarOutcome(%d)", int(o))
+}
+
+// War is a war fought by PlanWar.
+type War struct {
+	Outcome WarOutcome
+	Winner  string
+	Loser   string
+	// Lost is where the player loses their units, if anywhere.
+	Lost Location
+}
+
+// HandleWar fights a war and applies its losses straight away.
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
+	w := gs.PlanWar(rw)
+	gs.ApplyWar(w)
+	return w.Outcome, w.Winner, w.Loser
+}
+
+// PlanWar fights a war and reports how it went, without changing the game
+// state; see ApplyWar.
+func (gs *GameState) PlanWar(rw RecognitionOfWar) (w War) {
+	defer func() {
+		slog.Debug("handled war",
+			"username", gs.GetUsername(),
+			"attacker", rw.Attacker.Username,
+			"defender", rw.Defender.Username,
+			"outcome", w.Outcome.String(),
+			"winner", w.Winner)
+		warsTotal.WithLabelValues(w.Outcome.String()).Inc()
+	}()
 	defer fmt.Println("------------------------")
 	fmt.Println()
 	fmt.Println("==== War Declared ====")
@@ -24,18 +68,18 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 
 	if player.Username == rw.Defender.Username {
 		fmt.Printf("%s, you published the war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+		return War{Outcome: WarOutcomeNotInvolved}
 	}
 
 	if player.Username != rw.Attacker.Username {
 		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+		return War{Outcome: WarOutcomeNotInvolved}
 	}
 
 	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
 	if overlappingLocation == "" {
 		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
-		return WarOutcomeNoUnits, "", ""
+		return War{Outcome: WarOutcomeNoUnits}
 	}
 
 	attackerUnits := []Unit{}
@@ -67,25 +111,28 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
 		if player.Username == rw.Defender.Username {
 			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
+			return War{WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username, overlappingLocation}
 		}
-		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
+		return War{WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username, ""}
 	} else if defenderPower > attackerPower {
 		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
 		if player.Username == rw.Attacker.Username {
 			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
+			return War{WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username, overlappingLocation}
 		}
-		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
+		return War{WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username, ""}
 	}
 	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-	gs.removeUnitsInLocation(overlappingLocation)
-	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
+	return War{WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username, overlappingLocation}
+}
+
+// ApplyWar kills the units the player lost in a war fought by PlanWar.
+func (gs *GameState) ApplyWar(w War) {
+	if w.Lost == "" {
+		return
+	}
+	gs.removeUnitsInLocation(w.Lost)
+	fmt.Printf("Your units in %s have been killed.\n", w.Lost)
 }
 
 func unitsToPowerLevel(units []Unit) int {
@@ -0,0 +1,51 @@
+// Package logging configures log/slog for the Peril binaries. Diagnostics
+// go to stderr through slog; what the player or operator is meant to read
+// at the REPL is printed to stdout separately.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+type Config struct {
+	// Format is "text" or "json".
+	Format string
+	Level  slog.Level
+}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Format, "log-format", "text", "log format, text or json")
+	fs.TextVar(&c.Level, "log-level", slog.LevelInfo, "minimum log level: debug, info, warn or error")
+}
+
+func (c Config) Handler(w io.Writer) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: c.Level}
+	switch c.Format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", c.Format)
+}
+
+// Setup installs the configured logger as slog's default, writing to
+// stderr. The standard log package then writes through it too.
+func (c Config) Setup() error {
+	h, err := c.Handler(os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,133 @@
+// Package perilpb holds the protobuf form of Peril's messages, generated from
+// peril.proto, and conversions to and from the structs the game uses.
+//
+// Importing the package registers those structs with the pubsub protobuf
+// codec, so they can be published and consumed as "application/x-protobuf".
+package perilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative peril.proto
+
+import (
+	"sort"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func init() {
+	pubsub.RegisterProtoType(PlayingStateToProto, PlayingStateFromProto)
+	pubsub.RegisterProtoType(GameLogToProto, GameLogFromProto)
+	pubsub.RegisterProtoType(UnitToProto, UnitFromProto)
+	pubsub.RegisterProtoType(PlayerToProto, PlayerFromProto)
+	pubsub.RegisterProtoType(ArmyMoveToProto, ArmyMoveFromProto)
+	pubsub.RegisterProtoType(RecognitionOfWarToProto, RecognitionOfWarFromProto)
+}
+
+func PlayingStateToProto(ps routing.PlayingState) *PlayingState {
+	return &PlayingState{IsPaused: ps.IsPaused}
+}
+
+func PlayingStateFromProto(m *PlayingState) routing.PlayingState {
+	return routing.PlayingState{IsPaused: m.GetIsPaused()}
+}
+
+func GameLogToProto(gl routing.GameLog) *GameLog {
+	m := &GameLog{
+		Message:  gl.Message,
+		Username: gl.Username,
+	}
+	if !gl.CurrentTime.IsZero() {
+		m.CurrentTime = timestamppb.New(gl.CurrentTime)
+	}
+	return m
+}
+
+func GameLogFromProto(m *GameLog) routing.GameLog {
+	gl := routing.GameLog{
+		Message:  m.GetMessage(),
+		Username: m.GetUsername(),
+	}
+	if m.GetCurrentTime() != nil {
+		gl.CurrentTime = m.GetCurrentTime().AsTime().In(time.Local)
+	}
+	return gl
+}
+
+func UnitToProto(u gamelogic.Unit) *Unit {
+	return &Unit{
+		Id:       int64(u.ID),
+		Rank:     string(u.Rank),
+		Location: string(u.Location),
+	}
+}
+
+func UnitFromProto(m *Unit) gamelogic.Unit {
+	return gamelogic.Unit{
+		ID:       int(m.GetId()),
+		Rank:     gamelogic.UnitRank(m.GetRank()),
+		Location: gamelogic.Location(m.GetLocation()),
+	}
+}
+
+// PlayerToProto flattens the player's unit map into a list ordered by ID.
+func PlayerToProto(p gamelogic.Player) *Player {
+	m := &Player{Username: p.Username}
+	for _, u := range p.Units {
+		m.Units = append(m.Units, UnitToProto(u))
+	}
+	sort.Slice(m.Units, func(i, j int) bool {
+		return m.Units[i].Id < m.Units[j].Id
+	})
+	return m
+}
+
+func PlayerFromProto(m *Player) gamelogic.Player {
+	p := gamelogic.Player{
+		Username: m.GetUsername(),
+		Units:    make(map[int]gamelogic.Unit, len(m.GetUnits())),
+	}
+	for _, u := range m.GetUnits() {
+		unit := UnitFromProto(u)
+		p.Units[unit.ID] = unit
+	}
+	return p
+}
+
+func ArmyMoveToProto(mv gamelogic.ArmyMove) *ArmyMove {
+	m := &ArmyMove{
+		Player:     PlayerToProto(mv.Player),
+		ToLocation: string(mv.ToLocation),
+	}
+	for _, u := range mv.Units {
+		m.Units = append(m.Units, UnitToProto(u))
+	}
+	return m
+}
+
+func ArmyMoveFromProto(m *ArmyMove) gamelogic.ArmyMove {
+	mv := gamelogic.ArmyMove{
+		Player:     PlayerFromProto(m.GetPlayer()),
+		ToLocation: gamelogic.Location(m.GetToLocation()),
+	}
+	for _, u := range m.GetUnits() {
+		mv.Units = append(mv.Units, UnitFromProto(u))
+	}
+	return mv
+}
+
+func RecognitionOfWarToProto(rw gamelogic.RecognitionOfWar) *RecognitionOfWar {
+	return &RecognitionOfWar{
+		Attacker: PlayerToProto(rw.Attacker),
+		Defender: PlayerToProto(rw.Defender),
+	}
+}
+
+func RecognitionOfWarFromProto(m *RecognitionOfWar) gamelogic.RecognitionOfWar {
+	return gamelogic.RecognitionOfWar{
+		Attacker: PlayerFromProto(m.GetAttacker()),
+		Defender: PlayerFromProto(m.GetDefender()),
+	}
+}
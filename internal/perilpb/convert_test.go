@@ -0,0 +1,81 @@
+package perilpb_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	_ "github.com/bootdotdev/learn-pub-sub-starter/internal/perilpb"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	alice := gamelogic.Player{
+		Username: "alice",
+		Units: map[int]gamelogic.Unit{
+			3: {ID: 3, Rank: gamelogic.RankArtillery, Location: "asia"},
+			1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+			2: {ID: 2, Rank: gamelogic.RankCavalry, Location: "europe"},
+		},
+	}
+	bob := gamelogic.Player{
+		Username: "bob",
+		Units: map[int]gamelogic.Unit{
+			1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+		},
+	}
+	tests := []struct {
+		name string
+		val  any
+	}{
+		{"playing state", routing.PlayingState{IsPaused: true}},
+		{"army move", gamelogic.ArmyMove{
+			Player:     alice,
+			Units:      []gamelogic.Unit{alice.Units[2], alice.Units[1]},
+			ToLocation: "africa",
+		}},
+		{"recognition of war", gamelogic.RecognitionOfWar{Attacker: alice, Defender: bob}},
+		{"game log", routing.GameLog{
+			CurrentTime: time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.Local),
+			Message:     "{alice} won a war againts {bob}",
+			Username:    "alice",
+		}},
+		{"game log without a time", routing.GameLog{Message: "hello", Username: "bob"}},
+	}
+
+	codec, err := pubsub.CodecFor(pubsub.ContentTypeProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := codec.Marshal(tt.val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.New(reflect.TypeOf(tt.val))
+			if err := codec.Unmarshal(data, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !equal(got.Elem().Interface(), tt.val) {
+				t.Errorf("got %+v, want %+v", got.Elem().Interface(), tt.val)
+			}
+		})
+	}
+}
+
+// equal is reflect.DeepEqual, except that game log times only have to be
+// the same instant.
+func equal(got, want any) bool {
+	if gl, ok := got.(routing.GameLog); ok {
+		wantGL := want.(routing.GameLog)
+		if !gl.CurrentTime.Equal(wantGL.CurrentTime) {
+			return false
+		}
+		gl.CurrentTime, wantGL.CurrentTime = time.Time{}, time.Time{}
+		return gl == wantGL
+	}
+	return reflect.DeepEqual(got, want)
+}
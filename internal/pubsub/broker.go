@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher is the publishing half of an AMQP channel. *amqp.Channel
+// satisfies it directly, but is not safe for concurrent publishing; share a
+// PublisherPool between goroutines instead.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Subscriber is the declaring and consuming half of an AMQP channel.
+// *amqp.Channel satisfies it directly.
+type Subscriber interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+type Channel interface {
+	Publisher
+	Subscriber
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+// Broker hands out channels on a single connection, either to RabbitMQ
+// (NewAMQPBroker) or to an in-process MemoryBroker.
+type Broker interface {
+	Channel() (Channel, error)
+	Close() error
+}
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+func NewAMQPBroker(conn *amqp.Connection) Broker {
+	return &amqpBroker{conn: conn}
+}
+
+func Dial(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *amqpBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(receiver)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
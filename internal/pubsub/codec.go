@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/gob"
+	ContentTypeMsgpack = "application/x-msgpack"
+	ContentTypeCBOR    = "application/cbor"
+)
+
+// Codec encodes and decodes message bodies of one content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(gobCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(newCBORCodec())
+}
+
+// RegisterCodec makes c available to Publish and Subscribe under its content
+// type, replacing any codec already registered for it.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[mediaType(c.ContentType())] = c
+}
+
+// CodecFor returns the codec registered for contentType. Parameters such as
+// charset are ignored.
+func CodecFor(contentType string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[mediaType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", contentType)
+	}
+	return c, nil
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mt
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return ContentTypeJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var network bytes.Buffer
+	if err := gob.NewEncoder(&network).Encode(v); err != nil {
+		return nil, err
+	}
+	return network.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                { return ContentTypeMsgpack }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	// the default encodes times as whole Unix seconds
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano, TimeTag: cbor.EncTagRequired}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) ContentType() string                  { return ContentTypeCBOR }
+func (c cborCodec) Marshal(v any) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v any) error { return c.dec.Unmarshal(data, v) }
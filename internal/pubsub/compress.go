@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings understood by Publish and Subscribe.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultCompressionThreshold is the body size, in bytes, below which
+// WithCompression leaves messages uncompressed.
+const DefaultCompressionThreshold = 1024
+
+// Compressor compresses message bodies for one AMQP content encoding.
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
+
+// RegisterCompressor makes c available under its content encoding,
+// replacing any compressor already registered for it.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Encoding()] = c
+}
+
+func CompressorFor(encoding string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("no compressor registered for content encoding %q", encoding)
+	}
+	return c, nil
+}
+
+// Decompress undoes the content encoding of a message body. An empty or
+// "identity" encoding returns data unchanged.
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return data, nil
+	}
+	c, err := CompressorFor(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(data)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string { return EncodingGzip }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// zstdCompressor shares one encoder and decoder, whose EncodeAll and
+// DecodeAll are safe for concurrent use.
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompressor() zstdCompressor {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return zstdCompressor{enc: enc, dec: dec}
+}
+
+func (zstdCompressor) Encoding() string { return EncodingZstd }
+
+func (c zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.dec.DecodeAll(data, nil)
+}
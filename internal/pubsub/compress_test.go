@@ -0,0 +1,81 @@
+package pubsub_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	_ "github.com/bootdotdev/learn-pub-sub-starter/internal/perilpb"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type capturePublisher struct {
+	msg amqp.Publishing
+}
+
+func (p *capturePublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.msg = msg
+	return nil
+}
+
+func armyMove(units int) gamelogic.ArmyMove {
+	ranks := []gamelogic.UnitRank{gamelogic.RankInfantry, gamelogic.RankCavalry, gamelogic.RankArtillery}
+	locations := []gamelogic.Location{"americas", "europe", "africa", "asia", "australia", "antarctica"}
+	player := gamelogic.Player{Username: "benchmark", Units: map[int]gamelogic.Unit{}}
+	var moving []gamelogic.Unit
+	for i := 1; i <= units; i++ {
+		u := gamelogic.Unit{ID: i, Rank: ranks[i%len(ranks)], Location: locations[i%len(locations)]}
+		player.Units[i] = u
+		if u.Location == "europe" {
+			moving = append(moving, u)
+		}
+	}
+	return gamelogic.ArmyMove{Player: player, Units: moving, ToLocation: "europe"}
+}
+
+// BenchmarkArmyMove publishes and decodes an ArmyMove with every codec, raw
+// and compressed. bytes/msg is the body size on the wire; MB/s is relative to
+// the uncompressed body.
+func BenchmarkArmyMove(b *testing.B) {
+	ctx := context.Background()
+	for _, units := range []int{100, 500} {
+		mv := armyMove(units)
+		for _, contentType := range []string{pubsub.ContentTypeJSON, pubsub.ContentTypeGob, pubsub.ContentTypeMsgpack, pubsub.ContentTypeCBOR, pubsub.ContentTypeProtobuf} {
+			codec, err := pubsub.CodecFor(contentType)
+			if err != nil {
+				b.Fatal(err)
+			}
+			raw, err := codec.Marshal(mv)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, encoding := range []string{"raw", pubsub.EncodingGzip, pubsub.EncodingZstd} {
+				opts := []pubsub.PublishOption{pubsub.WithContentType(contentType)}
+				if encoding != "raw" {
+					opts = append(opts, pubsub.WithCompression(encoding, 1))
+				}
+				name := fmt.Sprintf("units=%d/%s/%s", units, codec.ContentType(), encoding)
+				b.Run(name, func(b *testing.B) {
+					pub := &capturePublisher{}
+					b.SetBytes(int64(len(raw)))
+					for i := 0; i < b.N; i++ {
+						if err := pubsub.Publish(ctx, pub, "", "army_moves.benchmark", mv, opts...); err != nil {
+							b.Fatal(err)
+						}
+						body, err := pubsub.Decompress(pub.msg.ContentEncoding, pub.msg.Body)
+						if err != nil {
+							b.Fatal(err)
+						}
+						var out gamelogic.ArmyMove
+						if err := codec.Unmarshal(body, &out); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(len(pub.msg.Body)), "bytes/msg")
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrUnconfirmed    = errors.New("channel closed before the broker confirmed the message")
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the message")
+)
+
+// ReturnError is reported for a mandatory publish that the broker could not
+// route to any queue.
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %s (%d)", e.Exchange, e.RoutingKey, e.ReplyText, e.ReplyCode)
+}
+
+// NackError is reported when the broker refuses to take responsibility for
+// a message.
+type NackError struct {
+	Exchange   string
+	RoutingKey string
+}
+
+func (e *NackError) Error() string {
+	return fmt.Sprintf("broker did not accept message to exchange %q with key %q", e.Exchange, e.RoutingKey)
+}
+
+type PublishResult struct {
+	Exchange   string
+	RoutingKey string
+	Err        error
+}
+
+type ConfirmOptions struct {
+	// Timeout bounds how long a publish waits for its confirm. Defaults to
+	// five seconds.
+	Timeout time.Duration
+	// OnResult, when set, makes publishes return as soon as the message is
+	// sent. The broker's verdict is reported to it once it arrives.
+	OnResult func(PublishResult)
+}
+
+// ConfirmPublisher publishes on a channel in confirm mode and turns broker
+// nacks and mandatory returns into errors.
+type ConfirmPublisher struct {
+	broker Broker
+	opts   ConfirmOptions
+
+	// mu serialises publishes so delivery tags match the broker's count.
+	mu     sync.Mutex
+	ch     Channel
+	seq    uint64
+	closed bool
+
+	pendingMu sync.Mutex
+	pending   map[uint64]*pendingConfirm
+}
+
+type pendingConfirm struct {
+	exchange  string
+	key       string
+	mandatory bool
+	result    chan error
+}
+
+func NewConfirmPublisher(broker Broker, opts ConfirmOptions) (*ConfirmPublisher, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	p := &ConfirmPublisher{broker: broker, opts: opts}
+	if _, err := p.lock(context.Background()); err != nil {
+		return nil, err
+	}
+	p.mu.Unlock()
+	return p, nil
+}
+
+// contextConfirmer is implemented by channels whose Confirm may have to wait
+// for the connection, like a ManagedConn's during an outage.
+type contextConfirmer interface {
+	confirm(ctx context.Context, noWait bool) error
+}
+
+// lock takes p.mu and returns the channel to publish on, opening one if
+// there is none. Opening can wait for a reconnect, so it is done without
+// holding p.mu and gives up when ctx ends.
+func (p *ConfirmPublisher) lock(ctx context.Context) (Channel, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, amqp.ErrClosed
+		}
+		if p.ch != nil {
+			return p.ch, nil
+		}
+		p.mu.Unlock()
+
+		ch, err := p.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+		returns := ch.NotifyReturn(make(chan amqp.Return, 64))
+
+		p.mu.Lock()
+		if p.closed || p.ch != nil {
+			// closed, or another publish opened one first
+			p.mu.Unlock()
+			ch.Close()
+			continue
+		}
+		pending := map[uint64]*pendingConfirm{}
+		p.pendingMu.Lock()
+		p.pending = pending
+		p.pendingMu.Unlock()
+		p.ch, p.seq = ch, 0
+		go p.listen(ch, pending, confirms, returns)
+		return ch, nil
+	}
+}
+
+func (p *ConfirmPublisher) open(ctx context.Context) (Channel, error) {
+	ch, err := p.broker.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not create channel: %w", err)
+	}
+	if cc, ok := ch.(contextConfirmer); ok {
+		err = cc.confirm(ctx, false)
+	} else {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not put channel into confirm mode: %w", err)
+	}
+	return ch, nil
+}
+
+func (p *ConfirmPublisher) listen(ch Channel, pending map[uint64]*pendingConfirm, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	var returned []amqp.Return
+	for conf := range confirms {
+		// the broker always sends a message's basic.return before its ack
+		returned = drainReturns(returns, returned)
+
+		p.pendingMu.Lock()
+		pc, ok := pending[conf.DeliveryTag]
+		delete(pending, conf.DeliveryTag)
+		p.pendingMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch {
+		case !conf.Ack:
+			err = &NackError{Exchange: pc.exchange, RoutingKey: pc.key}
+		case pc.mandatory && len(returned) > 0 &&
+			returned[0].Exchange == pc.exchange && returned[0].RoutingKey == pc.key:
+			r := returned[0]
+			returned = returned[1:]
+			err = &ReturnError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}
+		}
+		pc.result <- err
+	}
+
+	p.pendingMu.Lock()
+	for tag, pc := range pending {
+		delete(pending, tag)
+		pc.result <- ErrUnconfirmed
+	}
+	p.pendingMu.Unlock()
+
+	p.mu.Lock()
+	if p.ch == ch {
+		p.ch = nil
+	}
+	p.mu.Unlock()
+	// the channel is dead, but a wrapper around it, like a ManagedConn's,
+	// stays registered until it is closed
+	ch.Close()
+}
+
+func drainReturns(returns chan amqp.Return, returned []amqp.Return) []amqp.Return {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return returned
+			}
+			returned = append(returned, r)
+		default:
+			return returned
+		}
+	}
+}
+
+func (p *ConfirmPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	pc := &pendingConfirm{
+		exchange:  exchange,
+		key:       key,
+		mandatory: mandatory,
+		result:    make(chan error, 1),
+	}
+
+	// a channel that died since the last publish is replaced, and as the
+	// message never left, it is sent again on the new one
+	for retried := false; ; retried = true {
+		ch, err := p.lock(ctx)
+		if err != nil {
+			return err
+		}
+		p.seq++
+		tag := p.seq
+		p.pendingMu.Lock()
+		pending := p.pending
+		pending[tag] = pc
+		p.pendingMu.Unlock()
+
+		err = ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+		if err == nil {
+			p.mu.Unlock()
+			break
+		}
+		p.pendingMu.Lock()
+		delete(pending, tag)
+		p.pendingMu.Unlock()
+		p.seq--
+		closed := errors.Is(err, amqp.ErrClosed)
+		if closed {
+			ch.Close()
+			p.ch = nil
+		}
+		p.mu.Unlock()
+		if !closed || retried {
+			return err
+		}
+	}
+
+	if p.opts.OnResult != nil {
+		go func() {
+			p.opts.OnResult(PublishResult{Exchange: exchange, RoutingKey: key, Err: <-pc.result})
+		}()
+		return nil
+	}
+
+	timer := time.NewTimer(p.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-pc.result:
+		return err
+	case <-timer.C:
+		return ErrConfirmTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *ConfirmPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return amqp.ErrClosed
+	}
+	p.closed = true
+	if p.ch != nil {
+		return p.ch.Close()
+	}
+	return nil
+}
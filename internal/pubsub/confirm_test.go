@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestConfirmPublisher(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		mandatory bool
+		// a pointer to the type of error wanted, or nil
+		err any
+	}{
+		{"routed", routing.PauseKey, true, nil},
+		{"returned", "nobody", true, new(*ReturnError)},
+		{"unroutable but not mandatory", "nobody", false, nil},
+		{"nacked", "full", false, new(*NackError)},
+	}
+	for _, async := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if async {
+				name += " with OnResult"
+			}
+			t.Run(name, func(t *testing.T) {
+				ctx := context.Background()
+				_, conn := newTestBroker(t)
+				declareFullQueue(t, conn)
+				ch, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ch.Close()
+
+				var opts ConfirmOptions
+				results := make(chan PublishResult, 1)
+				if async {
+					opts.OnResult = func(r PublishResult) { results <- r }
+				}
+				pub, err := NewConfirmPublisher(conn, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer pub.Close()
+
+				err = pub.PublishWithContext(ctx, routing.ExchangePerilDirect, tt.key, tt.mandatory, false, amqp.Publishing{Body: []byte("{}")})
+				if async {
+					if err != nil {
+						t.Fatalf("publish with OnResult: %v", err)
+					}
+					r := receive(t, results)
+					if r.Exchange != routing.ExchangePerilDirect || r.RoutingKey != tt.key {
+						t.Errorf("result for %s/%s", r.Exchange, r.RoutingKey)
+					}
+					err = r.Err
+				}
+				if tt.err == nil {
+					if err != nil {
+						t.Errorf("got %v", err)
+					}
+				} else if !errors.As(err, tt.err) {
+					t.Errorf("got %v, want a %T", err, tt.err)
+				}
+			})
+		}
+	}
+}
+
+func TestConfirmPublisherTimeout(t *testing.T) {
+	pub, err := NewConfirmPublisher(silentBroker{}, ConfirmOptions{Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	err = pub.PublishWithContext(context.Background(), routing.ExchangePerilDirect, routing.PauseKey, false, false, amqp.Publishing{})
+	if !errors.Is(err, ErrConfirmTimeout) {
+		t.Errorf("got %v, want %v", err, ErrConfirmTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = pub.PublishWithContext(ctx, routing.ExchangePerilDirect, routing.PauseKey, false, false, amqp.Publishing{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v with a cancelled context", err)
+	}
+}
+
+func TestConfirmPublisherReplacesDeadChannel(t *testing.T) {
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+	ch, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	rec := &recordingBroker{Broker: conn}
+	pub, err := NewConfirmPublisher(rec, ConfirmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	publish := func() error {
+		return pub.PublishWithContext(ctx, routing.ExchangePerilDirect, routing.PauseKey, true, false, amqp.Publishing{Body: []byte("{}")})
+	}
+	if err := publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// kill the channel under the publisher, as the broker would
+	first := rec.recorded()[0]
+	first.Channel.Close()
+	eventually(t, first.closed.Load)
+
+	if err := publish(); err != nil {
+		t.Fatalf("publish after the channel died: %v", err)
+	}
+	if n := len(rec.recorded()); n != 2 {
+		t.Errorf("opened %d channels, want 2", n)
+	}
+	q, err := ch.QueueDeclare("pause.test", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != 2 {
+		t.Errorf("%d messages queued, want 2", q.Messages)
+	}
+}
+
+// silentBroker's channels take every publish but never confirm one.
+type silentBroker struct{}
+
+func (silentBroker) Channel() (Channel, error) { return &silentChannel{}, nil }
+func (silentBroker) Close() error              { return nil }
+
+type silentChannel struct {
+	Channel
+
+	mu       sync.Mutex
+	confirms chan amqp.Confirmation
+}
+
+func (c *silentChannel) Confirm(noWait bool) error { return nil }
+
+func (c *silentChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *silentChannel) NotifyReturn(r chan amqp.Return) chan amqp.Return { return r }
+
+func (c *silentChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return nil
+}
+
+func (c *silentChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.confirms != nil {
+		close(c.confirms)
+		c.confirms = nil
+	}
+	return nil
+}
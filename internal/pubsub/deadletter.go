@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareDeadLetterTopology declares the peril_dlx exchange that every queue
+// dead-letters into, and the peril_dlq queue that collects what arrives there.
+func DeclareDeadLetterTopology(ctx context.Context, conn Broker) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %w", err)
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(routing.ExchangePerilDLX, amqp.ExchangeFanout, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("could not declare %s: %w", routing.ExchangePerilDLX, err)
+	}
+	_, err = ch.QueueDeclare(routing.QueuePerilDLQ, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("could not declare %s: %w", routing.QueuePerilDLQ, err)
+	}
+	err = ch.QueueBind(routing.QueuePerilDLQ, "", routing.ExchangePerilDLX, false, nil)
+	if err != nil {
+		return fmt.Errorf("could not bind %s: %w", routing.QueuePerilDLQ, err)
+	}
+	return nil
+}
+
+// DeadLetter is a message read back from the dead-letter queue, together
+// with where it was originally published and why it was dead-lettered.
+type DeadLetter struct {
+	Delivery   amqp.Delivery
+	Exchange   string
+	RoutingKey string
+	Queue      string
+	Reason     string
+	Count      int64
+}
+
+// ParseDeadLetter recovers a message's origin from the broker's x-death
+// headers, or from the headers DeadLetterDecodeErrors and retries stamp.
+func ParseDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		Delivery:   d,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+		Count:      1,
+	}
+
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		// the most recent death comes first
+		if death, ok := deaths[0].(amqp.Table); ok {
+			dl.Queue, _ = death["queue"].(string)
+			dl.Reason, _ = death["reason"].(string)
+			dl.Exchange, _ = death["exchange"].(string)
+			if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+			if n, ok := tableInt(death, "count"); ok {
+				dl.Count = n
+			}
+		}
+	}
+
+	if v, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		dl.Exchange = v
+	}
+	if v, ok := d.Headers[HeaderOriginalRoutingKey].(string); ok {
+		dl.RoutingKey = v
+	}
+	if v, ok := d.Headers[HeaderOriginalQueue].(string); ok {
+		dl.Queue = v
+	}
+	if v, ok := d.Headers[HeaderDecodeError].(string); ok {
+		dl.Reason = "decode error: " + v
+	}
+	return dl
+}
+
+// Replay publishes the message again to its original exchange and routing
+// key, without the bookkeeping headers it picked up on the way to the
+// dead-letter queue. The publish is mandatory, and pub should confirm it,
+// such as a ConfirmPublisher, so that the dead-lettered copy is only
+// settled once the message is safely back in a queue.
+func (dl DeadLetter) Replay(ctx context.Context, pub Publisher) error {
+	d := dl.Delivery
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		switch {
+		case k == "x-death",
+			strings.HasPrefix(k, "x-first-death-"),
+			strings.HasPrefix(k, "x-last-death-"),
+			k == HeaderDecodeError,
+			k == HeaderCodec,
+			k == HeaderOriginalExchange,
+			k == HeaderOriginalRoutingKey,
+			k == HeaderOriginalQueue,
+			k == HeaderAttempt:
+			continue
+		}
+		headers[k] = v
+	}
+
+	return pub.PublishWithContext(ctx, dl.Exchange, dl.RoutingKey, true, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+}
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeadLetterReplay(t *testing.T) {
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	declareFullQueue(t, conn)
+
+	sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType { return NackDiscard })
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	var msg amqp.Delivery
+	eventually(t, func() bool {
+		var ok bool
+		msg, ok, err = ch.Get(routing.QueuePerilDLQ, true)
+		return ok || err != nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+	dl := ParseDeadLetter(msg)
+
+	pub, err := NewConfirmPublisher(conn, ConfirmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := dl.Replay(ctx, pub); err != nil {
+		t.Fatal(err)
+	}
+	replayed, ok, err := ch.Get("pause.test", true)
+	if err != nil || !ok {
+		t.Fatalf("replay did not reach pause.test: %v, %v", ok, err)
+	}
+	if replayed.MessageId != msg.MessageId {
+		t.Errorf("replayed message %q as %q", msg.MessageId, replayed.MessageId)
+	}
+	if _, ok := replayed.Headers["x-death"]; ok {
+		t.Error("replay kept the x-death header")
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		err  any
+	}{
+		{"unroutable", "nobody", new(*ReturnError)},
+		{"refused", "full", new(*NackError)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := dl
+			dl.RoutingKey = tt.key
+			err := dl.Replay(ctx, pub)
+			if !errors.As(err, tt.err) {
+				t.Errorf("got %v, want a %T", err, tt.err)
+			}
+		})
+	}
+}
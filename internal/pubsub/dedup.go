@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DedupStore remembers the IDs of messages that have been handled.
+type DedupStore interface {
+	// Seen reports whether id has been recorded and has not expired.
+	Seen(id string) (bool, error)
+	// Record remembers id as handled.
+	Record(id string) error
+}
+
+// Deduplicate acks messages whose ID is already in store without handling
+// them, and records the ID of every message its handler acks or discards.
+// Messages that are requeued or retried are not recorded, so they are
+// handled again when they come back. Messages without an ID are always
+// handled.
+//
+// Two copies of a message handled at the same time by different workers
+// can both get through; use WithOrderingKey to keep them on one worker.
+// A store that fails is logged and treated as having seen nothing.
+func Deduplicate(store DedupStore) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg amqp.Delivery) AckType {
+			if msg.MessageId == "" {
+				return next(ctx, msg)
+			}
+			seen, err := store.Seen(msg.MessageId)
+			if err != nil {
+				slog.Warn("could not check for duplicate message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId, "error", err)
+			}
+			if seen {
+				slog.Debug("skipped duplicate message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId)
+				duplicatesTotal.WithLabelValues(msg.Exchange).Inc()
+				return Ack
+			}
+			ack := next(ctx, msg)
+			if ack == Ack || ack == NackDiscard {
+				if err := store.Record(msg.MessageId); err != nil {
+					slog.Warn("could not record handled message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId, "error", err)
+				}
+			}
+			return ack
+		}
+	}
+}
+
+// MemoryDedupStore keeps up to capacity IDs for ttl each, forgetting the
+// least recently recorded first. A zero ttl keeps IDs until they are
+// evicted.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	order *list.List // of *dedupEntry, most recent first
+	ids   map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		ids:      map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.ids[id]
+	if !ok {
+		return false, nil
+	}
+	e := el.Value.(*dedupEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		s.order.Remove(el)
+		delete(s.ids, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Record(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expires time.Time
+	if s.ttl > 0 {
+		expires = time.Now().Add(s.ttl)
+	}
+	if el, ok := s.ids[id]; ok {
+		el.Value.(*dedupEntry).expires = expires
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.ids[id] = s.order.PushFront(&dedupEntry{id: id, expires: expires})
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(*dedupEntry).id)
+	}
+	return nil
+}
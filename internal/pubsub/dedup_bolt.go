@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltDedupStore keeps message IDs in a bbolt database, so duplicates are
+// still recognised after a restart. IDs are forgotten after ttl; expired
+// ones are pruned when the store is opened and then at most once per ttl.
+type BoltDedupStore struct {
+	db     *bolt.DB
+	bucket []byte
+	ttl    time.Duration
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// OpenBoltDedupStore opens, or creates, the database at path and keeps IDs
+// in bucket, so several subscriptions can share one file.
+func OpenBoltDedupStore(path, bucket string, ttl time.Duration) (*BoltDedupStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open dedup store: %w", err)
+	}
+	s := &BoltDedupStore{db: db, bucket: []byte(bucket), ttl: ttl}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err == nil {
+		err = s.prune()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not prepare dedup store: %w", err)
+	}
+	return s, nil
+}
+
+func (s *BoltDedupStore) Seen(id string) (bool, error) {
+	var seen bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.bucket).Get([]byte(id))
+		seen = v != nil && !s.expired(v, time.Now())
+		return nil
+	})
+	return seen, err
+}
+
+func (s *BoltDedupStore) Record(id string) error {
+	if err := s.maybePrune(); err != nil {
+		return err
+	}
+	v := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(id), v)
+	})
+}
+
+func (s *BoltDedupStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltDedupStore) expired(v []byte, now time.Time) bool {
+	if s.ttl <= 0 || len(v) != 8 {
+		return false
+	}
+	recorded := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	return now.Sub(recorded) > s.ttl
+}
+
+func (s *BoltDedupStore) maybePrune() error {
+	s.mu.Lock()
+	due := s.ttl > 0 && time.Since(s.lastPruned) > s.ttl
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return s.prune()
+}
+
+func (s *BoltDedupStore) prune() error {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastPruned = now
+	s.mu.Unlock()
+	if s.ttl <= 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// deleting under a cursor skips the next key, so collect them first
+		b := tx.Bucket(s.bucket)
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if s.expired(v, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeduplicate(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		first AckType
+		// whether the second copy reaches the handler
+		handled bool
+	}{
+		{"acked", "1", Ack, false},
+		{"discarded", "1", NackDiscard, false},
+		{"requeued", "1", NackRequeue, true},
+		{"retried", "1", RetryLater, true},
+		{"no message id", "", Ack, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := Deduplicate(NewMemoryDedupStore(10, 0))(func(ctx context.Context, msg amqp.Delivery) AckType {
+				calls++
+				if calls == 1 {
+					return tt.first
+				}
+				return Ack
+			})
+			msg := amqp.Delivery{MessageId: tt.id}
+			if ack := handler(context.Background(), msg); ack != tt.first {
+				t.Errorf("first copy settled with %v, want %v", ack, tt.first)
+			}
+			if ack := handler(context.Background(), msg); ack != Ack {
+				t.Errorf("second copy settled with %v", ack)
+			}
+			if handled := calls == 2; handled != tt.handled {
+				t.Errorf("second copy handled = %v, want %v", handled, tt.handled)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupStoreEviction(t *testing.T) {
+	s := NewMemoryDedupStore(2, 0)
+	for _, id := range []string{"a", "b", "c", "b", "d"} {
+		if err := s.Record(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// recording b again made c the least recently recorded
+	for id, want := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		if seen, _ := s.Seen(id); seen != want {
+			t.Errorf("Seen(%q) = %v, want %v", id, seen, want)
+		}
+	}
+}
+
+func TestMemoryDedupStoreTTL(t *testing.T) {
+	s := NewMemoryDedupStore(10, 20*time.Millisecond)
+	s.Record("a")
+	if seen, _ := s.Seen("a"); !seen {
+		t.Error("forgot a before its ttl")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if seen, _ := s.Seen("a"); seen {
+		t.Error("remembered a after its ttl")
+	}
+}
+
+func TestBoltDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	s, err := OpenBoltDedupStore(path, "logs", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenBoltDedupStore(path, "logs", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := s.Seen("a"); err != nil || !seen {
+		t.Errorf("Seen after reopening = %v, %v", seen, err)
+	}
+	if seen, _ := s.Seen("b"); seen {
+		t.Error("saw an ID that was never recorded")
+	}
+	s.Close()
+
+	other, err := OpenBoltDedupStore(path, "wars", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if seen, _ := other.Seen("a"); seen {
+		t.Error("buckets share IDs")
+	}
+}
+
+func TestBoltDedupStoreTTL(t *testing.T) {
+	s, err := OpenBoltDedupStore(filepath.Join(t.TempDir(), "dedup.db"), "logs", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Record("a")
+	if seen, _ := s.Seen("a"); !seen {
+		t.Error("forgot a before its ttl")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if seen, _ := s.Seen("a"); seen {
+		t.Error("remembered a after its ttl")
+	}
+}
@@ -0,0 +1,130 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderSender names the player or service that published a message. The
+// AMQP user-id property is not used for this because RabbitMQ rejects
+// messages whose user-id differs from the connection's user.
+const HeaderSender = "x-peril-sender"
+
+// AppID is stamped on every message Publish sends. It defaults to the name
+// of the running binary.
+var AppID = filepath.Base(os.Args[0])
+
+type senderKey struct{}
+type correlationKey struct{}
+
+// WithSender returns a context whose publishes are stamped with sender.
+func WithSender(ctx context.Context, sender string) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender)
+}
+
+// WithCorrelationID returns a context whose publishes carry id as their
+// correlation ID. Without one, a message is its own correlation ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func SenderFrom(ctx context.Context) string {
+	s, _ := ctx.Value(senderKey{}).(string)
+	return s
+}
+
+func CorrelationIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Delivery is a decoded message together with its envelope.
+type Delivery[T any] struct {
+	Body T
+
+	MessageID     string
+	CorrelationID string
+	Sender        string
+	AppID         string
+	Timestamp     time.Time
+	Exchange      string
+	RoutingKey    string
+	ReplyTo       string
+	Redelivered   bool
+	Headers       amqp.Table
+	// StreamOffset is the message's position in a Stream queue.
+	StreamOffset int64
+
+	span trace.SpanContext
+}
+
+// Context returns ctx carrying the delivery's correlation ID and the span
+// it is being handled in, so that messages published in response continue
+// the same conversation and trace.
+func (d Delivery[T]) Context(ctx context.Context) context.Context {
+	if d.CorrelationID != "" {
+		ctx = WithCorrelationID(ctx, d.CorrelationID)
+	}
+	if d.span.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, d.span)
+	}
+	return ctx
+}
+
+func newDelivery[T any](ctx context.Context, msg amqp.Delivery, body T) Delivery[T] {
+	sender, _ := msg.Headers[HeaderSender].(string)
+	offset, _ := tableInt(msg.Headers, "x-stream-offset")
+	return Delivery[T]{
+		StreamOffset:  offset,
+		span:          trace.SpanContextFromContext(ctx),
+		Body:          body,
+		MessageID:     msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		Sender:        sender,
+		AppID:         msg.AppId,
+		Timestamp:     msg.Timestamp,
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		ReplyTo:       msg.ReplyTo,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+	}
+}
+
+// stamp fills in the envelope of a message about to be published.
+func stamp(ctx context.Context, msg *amqp.Publishing) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if msg.AppId == "" {
+		msg.AppId = AppID
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = CorrelationIDFrom(ctx)
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = msg.MessageId
+	}
+	if sender := SenderFrom(ctx); sender != "" {
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		msg.Headers[HeaderSender] = sender
+	}
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
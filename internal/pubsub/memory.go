@@ -0,0 +1,1248 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It supports direct,
+// topic and fanout exchanges, durable, auto-delete and exclusive queues,
+// manual and automatic acks, prefetch, exclusive consumers and consumer
+// priorities, requeueing and dead-lettering, message TTLs, queue expiry,
+// length limits with their overflow behaviours, quorum queues with delivery
+// limits, and streams read from an offset, which is enough to drive the
+// Peril handlers without a running broker.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*memConn]struct{}
+	nextID    int
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *memConn
+	args       amqp.Table
+	messages   []*memMessage
+	consumers  []*memConsumer
+	next       int
+	used       int
+	// first is the offset of a stream's oldest message, which is kept in
+	// messages along with the rest
+	first int64
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	returns     int64
+	expires     time.Time
+	stored      time.Time
+}
+
+func (q *memQueue) quorum() bool {
+	return q.args["x-queue-type"] == "quorum"
+}
+
+func (q *memQueue) stream() bool {
+	return q.args["x-queue-type"] == "stream"
+}
+
+func queueKind(args amqp.Table) any {
+	if args["x-queue-type"] == "classic" {
+		return nil
+	}
+	return args["x-queue-type"]
+}
+
+// requeue puts m back at the head of q. Quorum queues count how often a
+// message comes back in x-delivery-count, and dead-letter it once that
+// passes their x-delivery-limit.
+func (b *MemoryBroker) requeue(q *memQueue, m *memMessage) {
+	if q.stream() {
+		// a stream never gave the message up
+		return
+	}
+	m.redelivered = true
+	if q.quorum() {
+		m.returns++
+		// deliveries already handed out share the old headers
+		m.msg = copyPublishing(m.msg)
+		if m.msg.Headers == nil {
+			m.msg.Headers = amqp.Table{}
+		}
+		m.msg.Headers["x-delivery-count"] = m.returns
+		if limit, ok := tableInt(q.args, "x-delivery-limit"); ok && m.returns > limit {
+			b.deadLetter(q, m, "delivery_limit")
+			return
+		}
+	}
+	q.messages = append([]*memMessage{m}, q.messages...)
+}
+
+type memConn struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]struct{}
+	notify   []chan *amqp.Error
+	closed   bool
+}
+
+type memChannel struct {
+	conn       *memConn
+	prefetch   int
+	nextTag    uint64
+	unacked    map[uint64]*memUnacked
+	consumers  map[string]*memConsumer
+	confirming bool
+	publishSeq uint64
+	closed     bool
+
+	// notifyMu guards the listeners and is held while sending to them, so
+	// that closing the channel never races a send.
+	notifyMu sync.Mutex
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	message  *memMessage
+	consumer *memConsumer
+}
+
+type memConsumer struct {
+	tag       string
+	ch        *memChannel
+	queue     *memQueue
+	autoAck   bool
+	exclusive bool
+	priority  int64
+	prefetch  int
+	unacked   int
+	// offset is the next message of a stream to deliver
+	offset int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []amqp.Delivery
+	done bool
+	stop chan struct{}
+	out  chan amqp.Delivery
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*memConn]struct{}{},
+	}
+	b.exchanges[""] = &memExchange{name: "", kind: amqp.ExchangeDirect, durable: true}
+	b.exchanges["amq.direct"] = &memExchange{name: "amq.direct", kind: amqp.ExchangeDirect, durable: true}
+	b.exchanges["amq.topic"] = &memExchange{name: "amq.topic", kind: amqp.ExchangeTopic, durable: true}
+	b.exchanges["amq.fanout"] = &memExchange{name: "amq.fanout", kind: amqp.ExchangeFanout, durable: true}
+	return b
+}
+
+// Connect opens a new connection to the broker. Exclusive queues belong to
+// the connection that declared them and are deleted when it closes.
+func (b *MemoryBroker) Connect() Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &memConn{broker: b, channels: map[*memChannel]struct{}{}}
+	b.conns[c] = struct{}{}
+	return c
+}
+
+// Restart simulates a broker restart: every connection is closed, and only
+// durable exchanges, durable queues and persistent messages survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	conns := make([]*memConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.shutdown(memError(amqp.ConnectionForced, "broker restarted"))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+			continue
+		}
+		if q.stream() {
+			// streams keep every message on disk
+			continue
+		}
+		kept := q.messages[:0]
+		for _, m := range q.messages {
+			if m.msg.DeliveryMode == amqp.Persistent {
+				kept = append(kept, m)
+			}
+		}
+		q.messages = kept
+	}
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if bnd.queue != q.name {
+				kept = append(kept, bnd)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+// route delivers msg to the queues bound to exchange with key. It reports
+// how many there were, and whether any of them refused msg for being full.
+func (b *MemoryBroker) route(exchange, key string, msg amqp.Publishing) (int, bool, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return 0, false, memError(amqp.NotFound, "no exchange '%s'", exchange)
+	}
+
+	var targets []*memQueue
+	if ex.name == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, bnd := range ex.bindings {
+			if seen[bnd.queue] || !bindingMatches(ex.kind, bnd.key, key) {
+				continue
+			}
+			seen[bnd.queue] = true
+			targets = append(targets, b.queues[bnd.queue])
+		}
+	}
+
+	rejected := false
+	for _, q := range targets {
+		m := &memMessage{
+			exchange: exchange,
+			key:      key,
+			msg:      copyPublishing(msg),
+		}
+		if q.stream() {
+			b.append(q, m)
+			continue
+		}
+		if !b.admit(q, m) {
+			rejected = true
+			continue
+		}
+		if ttl, ok := messageTTL(q, msg); ok {
+			m.expires = time.Now().Add(ttl)
+			time.AfterFunc(ttl, func() {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				if b.queues[q.name] == q {
+					b.dispatch(q)
+				}
+			})
+		}
+		q.messages = append(q.messages, m)
+		b.dispatch(q)
+	}
+	return len(targets), rejected, nil
+}
+
+// append adds m to the stream q, then drops its oldest messages while it is
+// over its x-max-length-bytes.
+func (b *MemoryBroker) append(q *memQueue, m *memMessage) {
+	if m.msg.Headers == nil {
+		m.msg.Headers = amqp.Table{}
+	}
+	m.msg.Headers["x-stream-offset"] = q.first + int64(len(q.messages))
+	m.stored = time.Now()
+	q.messages = append(q.messages, m)
+
+	if maxBytes, ok := tableInt(q.args, "x-max-length-bytes"); ok {
+		size := int64(0)
+		for _, kept := range q.messages {
+			size += int64(len(kept.msg.Body))
+		}
+		for size > maxBytes && len(q.messages) > 1 {
+			size -= int64(len(q.messages[0].msg.Body))
+			q.messages = q.messages[1:]
+			q.first++
+		}
+	}
+	b.dispatch(q)
+}
+
+// admit applies q's x-max-length and x-max-length-bytes, which count the
+// messages waiting in it, to m, and reports whether q takes it. A full queue
+// dead-letters its oldest messages to make room unless its x-overflow says
+// to refuse m.
+func (b *MemoryBroker) admit(q *memQueue, m *memMessage) bool {
+	maxLen, hasLen := tableInt(q.args, "x-max-length")
+	maxBytes, hasBytes := tableInt(q.args, "x-max-length-bytes")
+	if !hasLen && !hasBytes {
+		return true
+	}
+	full := func() bool {
+		if hasLen && int64(len(q.messages)) >= maxLen {
+			return true
+		}
+		if hasBytes {
+			size := int64(len(m.msg.Body))
+			for _, waiting := range q.messages {
+				size += int64(len(waiting.msg.Body))
+			}
+			return size > maxBytes
+		}
+		return false
+	}
+
+	switch q.args["x-overflow"] {
+	case "reject-publish":
+		return !full()
+	case "reject-publish-dlx":
+		if full() {
+			b.deadLetter(q, m, "maxlen")
+			return false
+		}
+		return true
+	}
+	b.expire(q)
+	for full() && len(q.messages) > 0 {
+		head := q.messages[0]
+		q.messages = q.messages[1:]
+		b.deadLetter(q, head, "maxlen")
+	}
+	if full() {
+		// m alone is over the limit
+		b.deadLetter(q, m, "maxlen")
+		return false
+	}
+	return true
+}
+
+// touch restarts q's x-expires countdown. The queue is deleted if it then
+// goes that long without consumers, being redeclared or a Get.
+func (b *MemoryBroker) touch(q *memQueue) {
+	ttl, ok := tableInt(q.args, "x-expires")
+	if !ok {
+		return
+	}
+	q.used++
+	used := q.used
+	time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.queues[q.name] == q && q.used == used && len(q.consumers) == 0 {
+			b.deleteQueue(q)
+		}
+	})
+}
+
+// messageTTL combines the queue's x-message-ttl with the message's own
+// expiration, the shorter one winning as it does in RabbitMQ.
+func messageTTL(q *memQueue, msg amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := tableInt(q.args, "x-message-ttl")
+	if msg.Expiration != "" {
+		if exp, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil && (!ok || exp < ttl) {
+			ttl, ok = exp, true
+		}
+	}
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+// expire dead-letters expired messages from the head of the queue. Like
+// RabbitMQ, messages behind a live one wait until they reach the head.
+func (b *MemoryBroker) expire(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if m.expires.IsZero() || now.Before(m.expires) {
+			return
+		}
+		q.messages = q.messages[1:]
+		b.deadLetter(q, m, "expired")
+	}
+}
+
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	if q.stream() {
+		b.dispatchStream(q)
+		return
+	}
+	b.expire(q)
+	for len(q.messages) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		c.deliver(m)
+	}
+}
+
+// dispatchStream hands every consumer of the stream q the messages from its
+// offset on, as far as its prefetch allows. Consumers that fell behind the
+// stream's retention skip to its oldest message.
+func (b *MemoryBroker) dispatchStream(q *memQueue) {
+	end := q.first + int64(len(q.messages))
+	for _, c := range q.consumers {
+		c.offset = max(c.offset, q.first)
+		for c.offset < end && c.unacked < c.prefetch {
+			c.deliver(q.messages[c.offset-q.first])
+			c.offset++
+		}
+	}
+}
+
+// streamOffset is where a consumer of the stream q starts, given its
+// x-stream-offset argument.
+func (q *memQueue) streamOffset(arg any) (int64, error) {
+	end := q.first + int64(len(q.messages))
+	switch v := arg.(type) {
+	case nil:
+		return end, nil
+	case string:
+		switch v {
+		case "next":
+			return end, nil
+		case "first":
+			return q.first, nil
+		case "last":
+			// every publish is a chunk of its own here
+			return max(end-1, q.first), nil
+		}
+	case time.Time:
+		for i, m := range q.messages {
+			if !m.stored.Before(v) {
+				return q.first + int64(i), nil
+			}
+		}
+		return end, nil
+	}
+	if n, ok := tableInt(amqp.Table{"x-stream-offset": arg}, "x-stream-offset"); ok {
+		return min(max(n, q.first), end), nil
+	}
+	return 0, memError(amqp.PreconditionFailed, "invalid arg 'x-stream-offset' for queue '%s'", q.name)
+}
+
+func (b *MemoryBroker) deadLetter(q *memQueue, m *memMessage, reason string) {
+	if q.stream() {
+		return
+	}
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := copyPublishing(m.msg)
+	msg.Expiration = ""
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	var count int64 = 1
+	kept := make([]interface{}, 0, len(deaths)+1)
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == q.name && t["reason"] == reason {
+			if n, ok := t["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		kept = append(kept, d)
+	}
+	death := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        q.name,
+		"time":         time.Now(),
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.key},
+	}
+	msg.Headers["x-death"] = append([]interface{}{death}, kept...)
+	if _, ok := msg.Headers["x-first-death-queue"]; !ok {
+		msg.Headers["x-first-death-queue"] = q.name
+		msg.Headers["x-first-death-reason"] = reason
+		msg.Headers["x-first-death-exchange"] = m.exchange
+	}
+
+	b.route(dlx, key, msg)
+}
+
+// nextConsumer picks the highest priority consumer with room under its
+// prefetch, round-robin among those of equal priority.
+func (q *memQueue) nextConsumer() *memConsumer {
+	var best *memConsumer
+	var bestIdx int
+	for i := range q.consumers {
+		idx := (q.next + i) % len(q.consumers)
+		c := q.consumers[idx]
+		if !c.autoAck && c.prefetch != 0 && c.unacked >= c.prefetch {
+			continue
+		}
+		if best == nil || c.priority > best.priority {
+			best, bestIdx = c, idx
+		}
+	}
+	if best != nil {
+		q.next = (bestIdx + 1) % len(q.consumers)
+	}
+	return best
+}
+
+func (q *memQueue) removeConsumer(c *memConsumer) {
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+}
+
+func (c *memConn) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *memConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *memConn) Close() error {
+	return c.shutdown(nil)
+}
+
+func (c *memConn) shutdown(reason *amqp.Error) error {
+	b := c.broker
+	b.mu.Lock()
+	if c.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	for ch := range c.channels {
+		ch.close()
+	}
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == c {
+			b.deleteQueue(q)
+		}
+	}
+	delete(b.conns, c)
+	notify := c.notify
+	c.notify = nil
+	b.mu.Unlock()
+
+	for _, n := range notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+	return nil
+}
+
+func (ch *memChannel) broker() *MemoryBroker {
+	return ch.conn.broker
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker()
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	routed, rejected, err := b.route(exchange, key, msg)
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	var seq uint64
+	if ch.confirming {
+		ch.publishSeq++
+		seq = ch.publishSeq
+	}
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	b.mu.Unlock()
+
+	var returns []chan amqp.Return
+	if mandatory && routed == 0 {
+		returns = ch.returns
+	}
+	var confirms []chan amqp.Confirmation
+	if seq > 0 {
+		confirms = ch.confirms
+	}
+
+	// like the real broker, a basic.return is always sent before the ack
+	for _, r := range returns {
+		r <- amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+	}
+	for _, c := range confirms {
+		c <- amqp.Confirmation{DeliveryTag: seq, Ack: !rejected}
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return memError(amqp.NotImplemented, "exchange type '%s' not supported", kind)
+	}
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return memError(amqp.PreconditionFailed, "inequivalent arg for exchange '%s'", name)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	switch args["x-queue-type"] {
+	case nil, "classic":
+	case "quorum":
+		if !durable || autoDelete || exclusive {
+			return amqp.Queue{}, memError(amqp.PreconditionFailed, "invalid property for quorum queue '%s'", name)
+		}
+	case "stream":
+		if !durable || autoDelete || exclusive {
+			return amqp.Queue{}, memError(amqp.PreconditionFailed, "invalid property for stream queue '%s'", name)
+		}
+	default:
+		return amqp.Queue{}, memError(amqp.PreconditionFailed, "invalid arg 'x-queue-type' for queue '%s'", name)
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, memError(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if q.durable != durable {
+			return amqp.Queue{}, memError(amqp.PreconditionFailed, "inequivalent arg 'durable' for queue '%s'", name)
+		}
+		if queueKind(q.args) != queueKind(args) {
+			return amqp.Queue{}, memError(amqp.PreconditionFailed, "inequivalent arg 'x-queue-type' for queue '%s'", name)
+		}
+		b.touch(q)
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	b.touch(q)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if exchange == "" {
+		return memError(amqp.AccessRefused, "operation not permitted on the default exchange")
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return memError(amqp.NotFound, "no exchange '%s'", exchange)
+	}
+	if _, ok := b.queues[name]; !ok {
+		return memError(amqp.NotFound, "no queue '%s'", name)
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == name && bnd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if prefetchSize != 0 {
+		// like RabbitMQ
+		return memError(amqp.NotImplemented, "prefetch_size!=0 (%d)", prefetchSize)
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, memError(amqp.NotFound, "no queue '%s'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, memError(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	if exclusive && len(q.consumers) > 0 {
+		return nil, memError(amqp.AccessRefused, "queue '%s' in use, cannot consume exclusively", queue)
+	}
+	if len(q.consumers) > 0 && q.consumers[0].exclusive {
+		return nil, memError(amqp.AccessRefused, "queue '%s' in exclusive use", queue)
+	}
+	var offset int64
+	if q.stream() {
+		if autoAck {
+			return nil, memError(amqp.PreconditionFailed, "queue '%s' needs manual acks to be consumed", queue)
+		}
+		if ch.prefetch == 0 {
+			return nil, memError(amqp.PreconditionFailed, "queue '%s' needs a prefetch count to be consumed", queue)
+		}
+		var err error
+		if offset, err = q.streamOffset(args["x-stream-offset"]); err != nil {
+			return nil, err
+		}
+	}
+	priority, _ := tableInt(args, "x-priority")
+	if consumer == "" {
+		b.nextID++
+		consumer = fmt.Sprintf("ctag-%d", b.nextID)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, memError(amqp.NotAllowed, "attempt to reuse consumer tag '%s'", consumer)
+	}
+
+	c := &memConsumer{
+		tag:       consumer,
+		ch:        ch,
+		queue:     q,
+		autoAck:   autoAck,
+		exclusive: exclusive,
+		priority:  priority,
+		prefetch:  ch.prefetch,
+		offset:    offset,
+		stop:      make(chan struct{}),
+		out:       make(chan amqp.Delivery),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	go c.run()
+
+	b.dispatch(q)
+	return c.out, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	ch.removeConsumer(c)
+	c.cancel()
+	return nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, memError(amqp.NotFound, "no queue '%s'", queue)
+	}
+	if q.stream() {
+		return amqp.Delivery{}, false, memError(amqp.PreconditionFailed, "queue '%s' does not support basic.get", queue)
+	}
+	b.touch(q)
+	b.expire(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+
+	ch.nextTag++
+	tag := ch.nextTag
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{queue: q, message: m}
+	}
+	d := m.delivery(ch, tag)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, memError(amqp.NotFound, "no queue '%s'", name)
+	}
+	if q.stream() {
+		return 0, memError(amqp.PreconditionFailed, "queue '%s' does not support purge", name)
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close()
+	return nil
+}
+
+func (ch *memChannel) close() {
+	b := ch.broker()
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	ch.notifyMu.Lock()
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	for _, c := range ch.returns {
+		close(c)
+	}
+	ch.confirms, ch.returns = nil, nil
+	ch.notifyMu.Unlock()
+
+	touched := map[*memQueue]bool{}
+	for _, c := range ch.consumers {
+		ch.removeConsumer(c)
+		c.stopNow()
+		touched[c.queue] = true
+	}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		b.requeue(u.queue, u.message)
+		touched[u.queue] = true
+	}
+
+	for q := range touched {
+		if _, ok := b.queues[q.name]; ok {
+			b.dispatch(q)
+		}
+	}
+}
+
+func (ch *memChannel) removeConsumer(c *memConsumer) {
+	b := ch.broker()
+	delete(ch.consumers, c.tag)
+	q := c.queue
+	q.removeConsumer(c)
+	if len(q.consumers) == 0 {
+		if q.autoDelete {
+			b.deleteQueue(q)
+			return
+		}
+		b.touch(q)
+	}
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker()
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if requeue {
+			b.requeue(u.queue, u.message)
+			return
+		}
+		b.deadLetter(u.queue, u.message, "rejected")
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	}
+
+	touched := map[*memQueue]bool{}
+	for _, t := range tags {
+		u, ok := ch.unacked[t]
+		if !ok {
+			return memError(amqp.PreconditionFailed, "unknown delivery tag %d", t)
+		}
+		delete(ch.unacked, t)
+		if u.consumer != nil {
+			u.consumer.unacked--
+		}
+		fn(u)
+		touched[u.queue] = true
+	}
+	for q := range touched {
+		if _, ok := b.queues[q.name]; ok {
+			b.dispatch(q)
+		}
+	}
+	return nil
+}
+
+func (c *memConsumer) deliver(m *memMessage) {
+	ch := c.ch
+	ch.nextTag++
+	tag := ch.nextTag
+	if !c.autoAck {
+		ch.unacked[tag] = &memUnacked{queue: c.queue, message: m, consumer: c}
+		c.unacked++
+	}
+	d := m.delivery(ch, tag)
+	d.ConsumerTag = c.tag
+	c.push(d)
+}
+
+func (m *memMessage) delivery(ch *memChannel, tag uint64) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         m.msg.Headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+}
+
+func (c *memConsumer) push(d amqp.Delivery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = append(c.buf, d)
+	c.cond.Signal()
+}
+
+// cancel stops new deliveries but lets buffered ones drain, like basic.cancel.
+func (c *memConsumer) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	c.cond.Broadcast()
+}
+
+// stopNow drops anything still buffered, like closing the channel.
+func (c *memConsumer) stopNow() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	c.cond.Broadcast()
+}
+
+func (c *memConsumer) run() {
+	defer close(c.out)
+	for {
+		c.mu.Lock()
+		for len(c.buf) == 0 && !c.done {
+			c.cond.Wait()
+		}
+		if len(c.buf) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		d := c.buf[0]
+		c.buf = c.buf[1:]
+		c.mu.Unlock()
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		select {
+		case c.out <- d:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+// topicMatches implements AMQP topic matching, where "*" matches exactly
+// one word and "#" matches zero or more words.
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+func copyPublishing(msg amqp.Publishing) amqp.Publishing {
+	if msg.Headers != nil {
+		headers := make(amqp.Table, len(msg.Headers))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	return msg
+}
+
+func tableInt(t amqp.Table, key string) (int64, bool) {
+	switch v := t[key].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func memError(code int, format string, args ...any) *amqp.Error {
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+}
@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.bob", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.bob.extra", false},
+		{"army_moves.*", "war.bob", false},
+		{"*.bob", "war.bob", true},
+		{"#", "", true},
+		{"#", "a.b.c", true},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.b.c", true},
+		{"a.#.c", "a.b.d", false},
+		{"#.c", "c", true},
+		{"pause", "pause", true},
+		{"pause", "paused", false},
+	}
+	for _, tt := range tests {
+		got := topicMatches(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+		if got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryBrokerSettle(t *testing.T) {
+	tests := []struct {
+		name string
+		// acks are returned for the first deliveries, then Ack
+		acks        []AckType
+		deliveries  int
+		deadLetters []string
+	}{
+		{"ack", nil, 1, nil},
+		{"nack and requeue", []AckType{NackRequeue, NackRequeue}, 3, nil},
+		{"nack and discard", []AckType{NackDiscard}, 1, []string{"rejected"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			_, conn := newTestBroker(t)
+
+			got := make(chan Delivery[routing.PlayingState], 10)
+			n := 0
+			sub, err := SubscribeDelivery(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+				func(d Delivery[routing.PlayingState]) AckType {
+					got <- d
+					n++
+					if n <= len(tt.acks) {
+						return tt.acks[n-1]
+					}
+					return Ack
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+			for i := range tt.deliveries {
+				d := receive(t, got)
+				if !d.Body.IsPaused {
+					t.Errorf("delivery %d: got %+v", i, d.Body)
+				}
+				if d.Redelivered != (i > 0) {
+					t.Errorf("delivery %d: redelivered = %v", i, d.Redelivered)
+				}
+			}
+			expectNone(t, got)
+
+			var reasons []string
+			for _, dl := range deadLetters(t, conn) {
+				reasons = append(reasons, dl.Reason)
+				if dl.Queue != "pause.test" || dl.RoutingKey != routing.PauseKey {
+					t.Errorf("dead letter from %s with key %s", dl.Queue, dl.RoutingKey)
+				}
+			}
+			if strings.Join(reasons, ",") != strings.Join(tt.deadLetters, ",") {
+				t.Errorf("dead-lettered %v, want %v", reasons, tt.deadLetters)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerTransientQueue(t *testing.T) {
+	ctx := context.Background()
+	b, conn := newTestBroker(t)
+
+	other := b.Connect()
+	defer other.Close()
+	_, _, err := DeclareAndBind(ctx, other, routing.ExchangePerilDirect, "pause.bob", routing.PauseKey, Transient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// exclusive to the connection that declared it
+	if _, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.bob", routing.PauseKey, Transient); err == nil {
+		t.Error("declared another connection's exclusive queue")
+	}
+	other.Close()
+	if _, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.bob", routing.PauseKey, Transient); err != nil {
+		t.Errorf("queue outlived its connection: %v", err)
+	}
+}
+
+func TestMemoryBrokerFanout(t *testing.T) {
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+
+	var subs []chan routing.PlayingState
+	for _, name := range []string{"pause.alice", "pause.bob"} {
+		got := make(chan routing.PlayingState, 1)
+		sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, name, routing.PauseKey, Transient,
+			func(ps routing.PlayingState) AckType {
+				got <- ps
+				return Ack
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs = append(subs, got)
+	}
+
+	testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	for _, got := range subs {
+		if ps := receive(t, got); !ps.IsPaused {
+			t.Errorf("got %+v", ps)
+		}
+	}
+}
+
+// newTestBroker returns a MemoryBroker with the Peril topology declared,
+// and a connection to it that is closed when the test ends.
+func newTestBroker(t *testing.T) (*MemoryBroker, Broker) {
+	t.Helper()
+	b := NewMemoryBroker()
+	conn := b.Connect()
+	t.Cleanup(func() { conn.Close() })
+	if err := DeclarePerilTopology(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	return b, conn
+}
+
+func testPublish[T any](t *testing.T, conn Broker, exchange, key string, val T, opts ...PublishOption) {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := Publish(context.Background(), ch, exchange, key, val, opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive[T any](t *testing.T, c <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	panic("unreachable")
+}
+
+func expectNone[T any](t *testing.T, c <-chan T) {
+	t.Helper()
+	select {
+	case v := <-c:
+		t.Errorf("unexpected delivery %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// declareFullQueue declares a queue "full" that refuses everything routed to
+// it with the key "full" on peril_direct, as a full reject-publish queue
+// does.
+func declareFullQueue(t *testing.T, conn Broker) {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	_, err = ch.QueueDeclare("full", true, false, false, false, amqp.Table{"x-max-length": 0, "x-overflow": "reject-publish"})
+	if err == nil {
+		err = ch.QueueBind("full", "full", routing.ExchangePerilDirect, false, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadLetters takes everything in the dead-letter queue.
+func deadLetters(t *testing.T, conn Broker) []DeadLetter {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	var dls []DeadLetter
+	for {
+		msg, ok, err := ch.Get(routing.QueuePerilDLQ, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return dls
+		}
+		dls = append(dls, ParseDeadLetter(msg))
+	}
+}
@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with Prometheus' default registry, which the
+// binaries serve on -metrics-addr.
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "published_total",
+		Help:      "Messages published, by exchange, routing key prefix and codec.",
+	}, []string{"exchange", "prefix", "codec"})
+
+	deliveredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "delivered_total",
+		Help:      "Messages delivered to subscriptions, by queue.",
+	}, []string{"queue"})
+
+	handledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handled_total",
+		Help:      "Messages handled by subscriptions, by queue and the AckType their handler returned.",
+	}, []string{"queue", "outcome"})
+
+	decodeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "decode_failures_total",
+		Help:      "Messages that could not be decoded, by queue and codec.",
+	}, []string{"queue", "codec"})
+
+	duplicatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "duplicates_total",
+		Help:      "Messages skipped by Deduplicate as already handled, by exchange.",
+	}, []string{"exchange"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken to decode and handle a message, by queue and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"queue", "outcome"})
+)
+
+func observePublish(exchange, key, contentType string) {
+	prefix, _, _ := strings.Cut(key, ".")
+	publishedTotal.WithLabelValues(exchange, prefix, contentType).Inc()
+}
+
+func observeHandled(queue string, ack AckType, d time.Duration) {
+	handledTotal.WithLabelValues(queue, ack.String()).Inc()
+	handlerDuration.WithLabelValues(queue, ack.String()).Observe(d.Seconds())
+}
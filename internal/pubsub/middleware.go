@@ -0,0 +1,165 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Handler is what middleware wraps: decoding a delivery and running the
+// subscription's handler on it.
+type Handler func(ctx context.Context, msg amqp.Delivery) AckType
+
+type Middleware func(Handler) Handler
+
+// Chain composes middlewares so that the first one is outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// WithMiddleware wraps the subscription's handler in mws, the first one
+// outermost. It can be given several times; later middlewares are nested
+// inside earlier ones.
+func WithMiddleware(mws ...Middleware) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Middleware = append(o.Middleware, mws...)
+	}
+}
+
+// Recover turns a panicking handler into onPanic instead of crashing the
+// process with the message unacked.
+func Recover(onPanic AckType) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg amqp.Delivery) (ack AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("handler panicked",
+						"routing_key", msg.RoutingKey,
+						"message_id", msg.MessageId,
+						"panic", r,
+						"stack", string(debug.Stack()),
+						"outcome", onPanic.String())
+					ack = onPanic
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging logs every message with its outcome and how long it took, at
+// debug level. A nil logger uses slog's default.
+func Logging(logger *slog.Logger) Middleware {
+	return Timing(func(msg amqp.Delivery, ack AckType, d time.Duration) {
+		l := logger
+		if l == nil {
+			l = slog.Default()
+		}
+		l.Debug("handled message",
+			"exchange", msg.Exchange,
+			"routing_key", msg.RoutingKey,
+			"message_id", msg.MessageId,
+			"outcome", ack.String(),
+			"duration", d)
+	})
+}
+
+// Timing reports how long each message took to handle.
+func Timing(observe func(msg amqp.Delivery, ack AckType, d time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg amqp.Delivery) AckType {
+			start := time.Now()
+			ack := next(ctx, msg)
+			observe(msg, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout settles a message with onTimeout if its handler has not returned
+// within d, and cancels the handler's context. A handler that ignores it
+// keeps running in the background and its result is discarded.
+func Timeout(d time.Duration, onTimeout AckType) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg amqp.Delivery) AckType {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			result := make(chan AckType, 1)
+			panicked := make(chan any, 1)
+			go func() {
+				// hand panics back so Recover, outside Timeout, still sees them
+				defer func() {
+					if r := recover(); r != nil {
+						panicked <- r
+					}
+				}()
+				result <- next(ctx, msg)
+			}()
+			select {
+			case ack := <-result:
+				return ack
+			case r := <-panicked:
+				panic(r)
+			case <-ctx.Done():
+				slog.Warn("handler timed out",
+					"routing_key", msg.RoutingKey,
+					"message_id", msg.MessageId,
+					"timeout", d,
+					"outcome", onTimeout.String())
+				return onTimeout
+			}
+		}
+	}
+}
+
+type ackError struct {
+	ack AckType
+	err error
+}
+
+func (e *ackError) Error() string { return e.err.Error() }
+func (e *ackError) Unwrap() error { return e.err }
+
+// WithAck marks err to be settled with ack by HandleErrors.
+func WithAck(ack AckType, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ackError{ack: ack, err: err}
+}
+
+// AckFor maps a handler error to how its message is settled: nil acks,
+// errors marked with WithAck use their AckType and anything else is retried
+// later.
+func AckFor(err error) AckType {
+	if err == nil {
+		return Ack
+	}
+	var ae *ackError
+	if errors.As(err, &ae) {
+		return ae.ack
+	}
+	return RetryLater
+}
+
+// HandleErrors adapts a handler that reports failure as an error, see
+// AckFor. Errors are passed to report, if it is not nil, before the message
+// is settled.
+func HandleErrors[T any](h func(T) error, report func(error)) func(T) AckType {
+	return func(val T) AckType {
+		err := h(val)
+		if err != nil && report != nil {
+			report(err)
+		}
+		return AckFor(err)
+	}
+}
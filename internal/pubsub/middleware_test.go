@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRecover(t *testing.T) {
+	h := Recover(NackDiscard)(func(ctx context.Context, msg amqp.Delivery) AckType {
+		if msg.RoutingKey == "panic" {
+			panic("boom")
+		}
+		return NackRequeue
+	})
+	if ack := h(context.Background(), amqp.Delivery{RoutingKey: "panic"}); ack != NackDiscard {
+		t.Errorf("after a panic got %v, want %v", ack, NackDiscard)
+	}
+	if ack := h(context.Background(), amqp.Delivery{}); ack != NackRequeue {
+		t.Errorf("without a panic got %v, want %v", ack, NackRequeue)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	slow := Timeout(20*time.Millisecond, NackRequeue)(func(ctx context.Context, msg amqp.Delivery) AckType {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return Ack
+	})
+	if ack := slow(context.Background(), amqp.Delivery{}); ack != NackRequeue {
+		t.Errorf("got %v, want %v", ack, NackRequeue)
+	}
+	if err := receive(t, cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("handler context ended with %v", err)
+	}
+
+	fast := Timeout(time.Second, NackRequeue)(func(ctx context.Context, msg amqp.Delivery) AckType {
+		return NackDiscard
+	})
+	if ack := fast(context.Background(), amqp.Delivery{}); ack != NackDiscard {
+		t.Errorf("got %v, want %v", ack, NackDiscard)
+	}
+
+	// a panic inside Timeout's goroutine still reaches Recover
+	h := Chain(Recover(NackDiscard), Timeout(time.Second, NackRequeue))(func(ctx context.Context, msg amqp.Delivery) AckType {
+		panic("boom")
+	})
+	if ack := h(context.Background(), amqp.Delivery{}); ack != NackDiscard {
+		t.Errorf("after a panic got %v, want %v", ack, NackDiscard)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg amqp.Delivery) AckType {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	h := Chain(mw("outer"), mw("inner"))(func(ctx context.Context, msg amqp.Delivery) AckType {
+		order = append(order, "handler")
+		return Ack
+	})
+	h(context.Background(), amqp.Delivery{})
+	if got := strings.Join(order, ","); got != "outer,inner,handler" {
+		t.Errorf("ran %s", got)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name string
+		err  error
+		want AckType
+	}{
+		{"nil", nil, Ack},
+		{"plain", failed, RetryLater},
+		{"marked", WithAck(NackDiscard, failed), NackDiscard},
+		{"marked and wrapped", fmt.Errorf("could not handle: %w", WithAck(NackRequeue, failed)), NackRequeue},
+		{"marked nil", WithAck(NackDiscard, nil), Ack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported []error
+			h := HandleErrors(func(int) error { return tt.err }, func(err error) {
+				reported = append(reported, err)
+			})
+			if ack := h(0); ack != tt.want {
+				t.Errorf("got %v, want %v", ack, tt.want)
+			}
+			if tt.err == nil && len(reported) != 0 {
+				t.Errorf("reported %v", reported)
+			}
+			if tt.err != nil && (len(reported) != 1 || !errors.Is(reported[0], failed)) {
+				t.Errorf("reported %v, want %v", reported, tt.err)
+			}
+		})
+	}
+
+	// report is optional
+	if ack := HandleErrors(func(int) error { return failed }, nil)(0); ack != RetryLater {
+		t.Errorf("without report got %v", ack)
+	}
+}
@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+)
+
+var outboxBucket = []byte("outbox")
+
+type OutboxOptions struct {
+	// PollInterval is how often the relay looks for pending messages when it
+	// has not been told about new ones. Defaults to one second.
+	PollInterval time.Duration
+	// MaxBackoff caps the delay between attempts to publish a message the
+	// broker did not accept. Defaults to thirty seconds.
+	MaxBackoff time.Duration
+	// OnDropped, when set, is told about mandatory messages the broker
+	// returned as unroutable, which are dropped rather than retried. They
+	// are logged otherwise.
+	OnDropped func(PublishResult)
+}
+
+// Outbox records messages in a bbolt database before they are published,
+// so a message whose state change has been made is not lost if the broker
+// is unreachable or the process exits. Run relays recorded messages in
+// order, removing each once the broker has confirmed it; until then it is
+// retried, across restarts if need be. Messages keep their ID when retried,
+// so consumers using Deduplicate see each at most once.
+//
+// Use Enqueue, then make the state change only if it succeeded.
+type Outbox struct {
+	db   *bolt.DB
+	pub  Publisher
+	opts OutboxOptions
+	wake chan struct{}
+}
+
+type outboxEntry struct {
+	Exchange   string
+	Key        string
+	Mandatory  bool
+	Publishing amqp.Publishing
+}
+
+// OpenOutbox opens, or creates, the outbox at path. Messages are published
+// with pub, which should confirm them, such as a PublisherPool.
+func OpenOutbox(path string, pub Publisher, opts OutboxOptions) (*Outbox, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not prepare outbox: %w", err)
+	}
+	return &Outbox{db: db, pub: pub, opts: opts, wake: make(chan struct{}, 1)}, nil
+}
+
+// Enqueue encodes val as Publish would and records it in the outbox. Once
+// it returns nil the message will be published even if the process exits
+// first.
+func Enqueue[T any](ctx context.Context, o *Outbox, exchange, key string, val T, opts ...PublishOption) error {
+	cfg := newPublishConfig(opts)
+	msg, err := encode(ctx, key, val, cfg)
+	if err != nil {
+		return err
+	}
+	// the relay publishes in the trace the message was enqueued in
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Headers))
+
+	var buf bytes.Buffer
+	entry := outboxEntry{Exchange: exchange, Key: key, Mandatory: cfg.mandatory, Publishing: msg}
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return fmt.Errorf("could not encode outbox entry: %w", err)
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(binary.BigEndian.AppendUint64(nil, seq), buf.Bytes())
+	})
+	if err != nil {
+		return fmt.Errorf("could not record message in outbox: %w", err)
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of messages not yet published.
+func (o *Outbox) Pending() (int, error) {
+	var n int
+	err := o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(outboxBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Run relays recorded messages until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	backoff := time.Duration(0)
+	for {
+		err := o.relay(ctx)
+		if err != nil && ctx.Err() == nil {
+			backoff = min(max(2*backoff, 100*time.Millisecond), o.opts.MaxBackoff)
+			slog.Warn("could not relay outbox", "error", err, "backoff", backoff)
+		} else {
+			backoff = 0
+		}
+
+		// a new message does not make the broker any more willing, so only
+		// wake up early when not backing off
+		wake, wait := o.wake, o.opts.PollInterval
+		if backoff > 0 {
+			wake, wait = nil, backoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// relay publishes pending messages in order until there are none left or
+// one fails.
+func (o *Outbox) relay(ctx context.Context) error {
+	for ctx.Err() == nil {
+		var key []byte
+		var entry outboxEntry
+		err := o.db.View(func(tx *bolt.Tx) error {
+			k, v := tx.Bucket(outboxBucket).Cursor().First()
+			if k == nil {
+				return nil
+			}
+			key = append([]byte(nil), k...)
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&entry)
+		})
+		if err != nil {
+			return fmt.Errorf("could not read outbox: %w", err)
+		}
+		if key == nil {
+			return nil
+		}
+
+		msg := entry.Publishing
+		pubCtx := otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Headers))
+		err = publish(pubCtx, o.pub, entry.Exchange, entry.Key, entry.Mandatory, msg)
+		var returned *ReturnError
+		if errors.As(err, &returned) {
+			// retrying will not give the message anywhere to go
+			if o.opts.OnDropped != nil {
+				o.opts.OnDropped(PublishResult{Exchange: entry.Exchange, RoutingKey: entry.Key, Err: err})
+			} else {
+				slog.Error("dropped unroutable message from outbox",
+					"exchange", entry.Exchange,
+					"routing_key", entry.Key,
+					"message_id", msg.MessageId,
+					"error", err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("could not publish message %s: %w", msg.MessageId, err)
+		}
+
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(outboxBucket).Delete(key)
+		})
+		if err != nil {
+			return fmt.Errorf("could not mark message %s sent: %w", msg.MessageId, err)
+		}
+	}
+	return ctx.Err()
+}
+
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
@@ -0,0 +1,186 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakePublisher records what it publishes, failing the first fail attempts.
+type fakePublisher struct {
+	mu       sync.Mutex
+	fail     int
+	attempts []time.Time
+	done     chan amqp.Publishing
+}
+
+func newFakePublisher(fail int) *fakePublisher {
+	return &fakePublisher{fail: fail, done: make(chan amqp.Publishing, 10)}
+}
+
+func (p *fakePublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = append(p.attempts, time.Now())
+	if len(p.attempts) <= p.fail {
+		return errors.New("broker unavailable")
+	}
+	p.done <- msg
+	return nil
+}
+
+func TestOutboxOrderAcrossReopen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	pub := newFakePublisher(0)
+
+	o, err := OpenOutbox(path, pub, OutboxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"1", "2", "3"} {
+		if err := Enqueue(ctx, o, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", routing.GameLog{Message: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	o, err = OpenOutbox(path, pub, OutboxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n, err := o.Pending(); err != nil || n != 3 {
+		t.Fatalf("Pending after reopening = %d, %v", n, err)
+	}
+	for _, m := range []string{"4", "5"} {
+		if err := Enqueue(ctx, o, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", routing.GameLog{Message: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go o.Run(ctx)
+
+	for _, want := range []string{"1", "2", "3", "4", "5"} {
+		msg := receive(t, pub.done)
+		gl, err := decodeGameLog(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gl.Message != want {
+			t.Errorf("published %q, want %q", gl.Message, want)
+		}
+	}
+	// the last message is removed just after it is published
+	eventually(t, func() bool {
+		n, err := o.Pending()
+		return err == nil && n == 0
+	})
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pub := newFakePublisher(3)
+	const maxBackoff = 50 * time.Millisecond
+
+	o, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"), pub, OutboxOptions{MaxBackoff: maxBackoff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if err := Enqueue(ctx, o, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{}); err != nil {
+		t.Fatal(err)
+	}
+	go o.Run(ctx)
+	first := receive(t, pub.done)
+	// enqueued while backing off, so it must wait its turn
+	if err := Enqueue(ctx, o, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{}); err != nil {
+		t.Fatal(err)
+	}
+	second := receive(t, pub.done)
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	if len(pub.attempts) != 5 {
+		t.Fatalf("%d attempts, want 5", len(pub.attempts))
+	}
+	for i := 1; i < 4; i++ {
+		if gap := pub.attempts[i].Sub(pub.attempts[i-1]); gap < maxBackoff {
+			t.Errorf("attempt %d came %s after a failure, want at least %s", i, gap, maxBackoff)
+		}
+	}
+	if first.MessageId == "" || first.MessageId == second.MessageId {
+		t.Errorf("message IDs %q and %q", first.MessageId, second.MessageId)
+	}
+}
+
+func TestOutboxDropped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, conn := newTestBroker(t)
+	pub, err := NewPublisherPool(conn, PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	dropped := make(chan PublishResult, 1)
+	o, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"), pub, OutboxOptions{
+		OnDropped: func(r PublishResult) { dropped <- r },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	go o.Run(ctx)
+
+	// nobody is subscribed to pauses yet
+	err = Enqueue(ctx, o, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{}, Mandatory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := receive(t, dropped)
+	var returned *ReturnError
+	if r.RoutingKey != routing.PauseKey || !errors.As(r.Err, &returned) {
+		t.Errorf("dropped %+v", r)
+	}
+
+	got := make(chan routing.PlayingState, 1)
+	sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType {
+			got <- ps
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	err = Enqueue(ctx, o, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true}, Mandatory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps := receive(t, got); !ps.IsPaused {
+		t.Errorf("got %+v", ps)
+	}
+	expectNone(t, dropped)
+}
+
+func decodeGameLog(msg amqp.Publishing) (routing.GameLog, error) {
+	var gl routing.GameLog
+	codec, err := CodecFor(msg.ContentType)
+	if err != nil {
+		return gl, err
+	}
+	body, err := Decompress(msg.ContentEncoding, msg.Body)
+	if err != nil {
+		return gl, err
+	}
+	return gl, codec.Unmarshal(body, &gl)
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers stamped on messages that were dead-lettered because they could
+// not be decoded.
+const (
+	HeaderDecodeError        = "x-peril-decode-error"
+	HeaderCodec              = "x-peril-codec"
+	HeaderOriginalExchange   = "x-peril-original-exchange"
+	HeaderOriginalRoutingKey = "x-peril-original-routing-key"
+	HeaderOriginalQueue      = "x-peril-original-queue"
+)
+
+// DecodeFailure describes a delivery whose body could not be decoded into
+// the subscription's type.
+type DecodeFailure struct {
+	Delivery amqp.Delivery
+	Queue    string
+	Codec    string
+	Err      error
+}
+
+// DecodeErrorPolicy decides what happens to a delivery that failed to
+// decode. It is given a publisher in confirm mode that the subscription's
+// workers share, so it can republish the message; whatever AckType it
+// returns is then applied to the delivery.
+type DecodeErrorPolicy func(ctx context.Context, ch Publisher, f DecodeFailure) AckType
+
+// DeadLetterDecodeErrors is the default policy. It republishes the message
+// to the peril_dlx exchange with headers recording the error, the codec and
+// where the message came from, then acks the original. If the republish
+// fails the message is nacked without requeueing, which still dead-letters
+// it through the queue's x-dead-letter-exchange, just without the headers.
+func DeadLetterDecodeErrors(ctx context.Context, ch Publisher, f DecodeFailure) AckType {
+	msg := f.Delivery
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDecodeError] = f.Err.Error()
+	headers[HeaderCodec] = f.Codec
+	headers[HeaderOriginalExchange] = msg.Exchange
+	headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	headers[HeaderOriginalQueue] = f.Queue
+
+	err := ch.PublishWithContext(ctx, routing.ExchangePerilDLX, msg.RoutingKey, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+	if err != nil {
+		slog.Error("could not dead-letter undecodable message", "queue", f.Queue, "message_id", msg.MessageId, "error", err)
+		return NackDiscard
+	}
+	return Ack
+}
+
+// DiscardDecodeErrors drops undecodable messages, letting the queue's
+// x-dead-letter-exchange pick them up without any extra headers.
+func DiscardDecodeErrors(ctx context.Context, ch Publisher, f DecodeFailure) AckType {
+	return NackDiscard
+}
+
+func handleDecodeError(ctx context.Context, ch Publisher, policy DecodeErrorPolicy, f DecodeFailure) AckType {
+	slog.Warn("could not decode message",
+		"queue", f.Queue,
+		"routing_key", f.Delivery.RoutingKey,
+		"message_id", f.Delivery.MessageId,
+		"codec", f.Codec,
+		"error", f.Err)
+	decodeFailuresTotal.WithLabelValues(f.Queue, f.Codec).Inc()
+	return policy(ctx, ch, f)
+}
@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultPoolSize is the number of channels a PublisherPool opens when
+// PoolOptions.Size is not set.
+const DefaultPoolSize = 4
+
+type PoolOptions struct {
+	// Size is the number of channels to publish on. Defaults to
+	// DefaultPoolSize.
+	Size int
+	// Confirm configures each channel's ConfirmPublisher.
+	Confirm ConfirmOptions
+}
+
+// PublisherPool spreads publishes over several channels in confirm mode. It
+// is safe to share between goroutines: each channel only ever has one
+// publish in flight on the wire, and goroutines waiting for confirms do not
+// hold up publishes on the other channels.
+type PublisherPool struct {
+	publishers []*ConfirmPublisher
+	next       atomic.Uint64
+}
+
+func NewPublisherPool(broker Broker, opts PoolOptions) (*PublisherPool, error) {
+	if opts.Size <= 0 {
+		opts.Size = DefaultPoolSize
+	}
+	p := &PublisherPool{}
+	for range opts.Size {
+		pub, err := NewConfirmPublisher(broker, opts.Confirm)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.publishers = append(p.publishers, pub)
+	}
+	return p, nil
+}
+
+// PublishWithContext publishes on the next channel in turn. A channel that
+// has closed is reopened on its next publish, see ConfirmPublisher.
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	i := p.next.Add(1) % uint64(len(p.publishers))
+	return p.publishers[i].PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (p *PublisherPool) Close() error {
+	var errs []error
+	for _, pub := range p.publishers {
+		errs = append(errs, pub.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestPublisherPoolConcurrent(t *testing.T) {
+	const goroutines, each = 8, 25
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+	ch, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	pool, err := NewPublisherPool(conn, PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*each)
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				errs <- Publish(ctx, pool, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{}, Mandatory())
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := ch.QueueDeclare("pause.test", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != goroutines*each {
+		t.Errorf("%d messages queued, want %d", q.Messages, goroutines*each)
+	}
+}
+
+func TestPublisherPoolAfterFailure(t *testing.T) {
+	const size = 2
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	mc := newManagedTestConn(t, b)
+	if err := DeclarePerilTopology(ctx, mc); err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingBroker{Broker: mc}
+	pool, err := NewPublisherPool(rec, PoolOptions{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	publish := func() error {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		return Publish(ctx, pool, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{})
+	}
+	for range size {
+		if err := publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every publisher's channel dies, and each is replaced on its next
+	// publish once the connection is back
+	b.Restart()
+	for i := range 2 * size {
+		if err := publish(); err != nil {
+			t.Fatalf("publish %d after restart: %v", i, err)
+		}
+	}
+
+	channels := rec.recorded()
+	if len(channels) != 2*size {
+		t.Fatalf("opened %d channels, want %d", len(channels), 2*size)
+	}
+	for i, ch := range channels {
+		if closed := ch.closed.Load(); closed != (i < size) {
+			t.Errorf("channel %d closed = %v", i, closed)
+		}
+	}
+}
+
+// newManagedTestConn returns a ManagedConn to b that redials quickly and is
+// closed when the test ends.
+func newManagedTestConn(t *testing.T, b *MemoryBroker) *ManagedConn {
+	t.Helper()
+	mc, err := NewManagedConn(func() (Broker, error) { return b.Connect(), nil }, ReconnectOptions{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mc.Close() })
+	return mc
+}
+
+// recordingBroker remembers the channels it hands out.
+type recordingBroker struct {
+	Broker
+
+	mu       sync.Mutex
+	channels []*recordedChannel
+}
+
+type recordedChannel struct {
+	Channel
+	closed atomic.Bool
+}
+
+func (b *recordingBroker) Channel() (Channel, error) {
+	ch, err := b.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	rc := &recordedChannel{Channel: ch}
+	b.mu.Lock()
+	b.channels = append(b.channels, rc)
+	b.mu.Unlock()
+	return rc, nil
+}
+
+func (b *recordingBroker) recorded() []*recordedChannel {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*recordedChannel(nil), b.channels...)
+}
+
+func (c *recordedChannel) Close() error {
+	c.closed.Store(true)
+	return c.Channel.Close()
+}
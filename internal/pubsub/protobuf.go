@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const ContentTypeProtobuf = "application/x-protobuf"
+
+func init() {
+	RegisterCodec(protoCodec{})
+}
+
+type protoConverter struct {
+	toProto   func(v any) proto.Message
+	fromProto func(m proto.Message, v any)
+	newProto  func() proto.Message
+}
+
+var protoMessageType = reflect.TypeFor[proto.Message]()
+
+var (
+	protoTypesMu sync.RWMutex
+	protoTypes   = map[reflect.Type]protoConverter{}
+)
+
+// RegisterProtoType lets the protobuf codec carry T, which is not itself a
+// protobuf message, on the wire as M. Values that already are protobuf
+// messages need no registration.
+func RegisterProtoType[T any, M proto.Message](to func(T) M, from func(M) T) {
+	msgType := reflect.TypeFor[M]()
+	if msgType.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("pubsub: protobuf message type %v is not a pointer", msgType))
+	}
+	protoTypesMu.Lock()
+	defer protoTypesMu.Unlock()
+	protoTypes[reflect.TypeFor[T]()] = protoConverter{
+		toProto: func(v any) proto.Message { return to(v.(T)) },
+		fromProto: func(m proto.Message, v any) {
+			*v.(*T) = from(m.(M))
+		},
+		newProto: func() proto.Message {
+			return reflect.New(msgType.Elem()).Interface().(proto.Message)
+		},
+	}
+}
+
+func protoConverterFor(t reflect.Type) (protoConverter, error) {
+	protoTypesMu.RLock()
+	defer protoTypesMu.RUnlock()
+	c, ok := protoTypes[t]
+	if !ok {
+		return protoConverter{}, fmt.Errorf("no protobuf type registered for %v", t)
+	}
+	return c, nil
+}
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	conv, err := protoConverterFor(reflect.TypeOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(conv.toProto(v))
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return fmt.Errorf("can not unmarshal protobuf into non-pointer %v", t)
+	}
+	if t.Elem().Kind() == reflect.Pointer && t.Elem().Implements(protoMessageType) {
+		// a subscription to *M decodes into a **M
+		m := reflect.New(t.Elem().Elem())
+		if err := proto.Unmarshal(data, m.Interface().(proto.Message)); err != nil {
+			return err
+		}
+		reflect.ValueOf(v).Elem().Set(m)
+		return nil
+	}
+	conv, err := protoConverterFor(t.Elem())
+	if err != nil {
+		return err
+	}
+	m := conv.newProto()
+	if err := proto.Unmarshal(data, m); err != nil {
+		return err
+	}
+	conv.fromProto(m, v)
+	return nil
+}
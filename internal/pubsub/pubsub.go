@@ -1,24 +1,118 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	dat, err := json.Marshal(val)
+type PublishOption func(*publishConfig)
+
+type publishConfig struct {
+	mandatory   bool
+	contentType string
+	encoding    string
+	threshold   int
+}
+
+// Mandatory asks the broker to return the message if no queue is bound to
+// take it. Combined with a ConfirmPublisher this surfaces as a *ReturnError.
+func Mandatory() PublishOption {
+	return func(c *publishConfig) {
+		c.mandatory = true
+	}
+}
+
+// WithContentType selects the codec Publish encodes with, overriding the
+// one configured for the routing key in routing.Encodings.
+func WithContentType(contentType string) PublishOption {
+	return func(c *publishConfig) {
+		c.contentType = contentType
+	}
+}
+
+// WithCompression compresses bodies of at least threshold bytes with the
+// compressor registered for encoding, and records it in ContentEncoding so
+// subscribers can undo it. A threshold of 0 uses
+// DefaultCompressionThreshold.
+func WithCompression(encoding string, threshold int) PublishOption {
+	return func(c *publishConfig) {
+		if threshold <= 0 {
+			threshold = DefaultCompressionThreshold
+		}
+		c.encoding, c.threshold = encoding, threshold
+	}
+}
+
+func newPublishConfig(opts []PublishOption) publishConfig {
+	var c publishConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// Publish encodes val with the codec for the key's content type, see
+// routing.ContentType, falling back to JSON, and publishes it.
+func Publish[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	cfg := newPublishConfig(opts)
+	msg, err := encode(ctx, key, val, cfg)
 	if err != nil {
 		return err
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        dat,
-	})
+	return publish(ctx, ch, exchange, key, cfg.mandatory, msg)
+}
+
+// encode builds the stamped message Publish would send for val.
+func encode[T any](ctx context.Context, key string, val T, cfg publishConfig) (amqp.Publishing, error) {
+	codec, err := CodecFor(contentTypeFor(cfg.contentType, key))
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	dat, err := codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	var encoding string
+	if cfg.encoding != "" && len(dat) >= cfg.threshold {
+		c, err := CompressorFor(cfg.encoding)
+		if err != nil {
+			return amqp.Publishing{}, err
+		}
+		if dat, err = c.Compress(dat); err != nil {
+			return amqp.Publishing{}, fmt.Errorf("could not compress message: %w", err)
+		}
+		encoding = c.Encoding()
+	}
+	msg := amqp.Publishing{
+		ContentType:     codec.ContentType(),
+		ContentEncoding: encoding,
+		Body:            dat,
+	}
+	stamp(ctx, &msg)
+	return msg, nil
+}
+
+func publish(ctx context.Context, ch Publisher, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	ctx, span := startPublish(ctx, exchange, key, &msg)
+	err := ch.PublishWithContext(ctx, exchange, key, mandatory, false, msg)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	observePublish(exchange, key, msg.ContentType)
+	return nil
+}
+
+func PublishJSON[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, ch, exchange, key, val, append(opts[:len(opts):len(opts)], WithContentType(ContentTypeJSON))...)
+}
+
+func PublishGob[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, ch, exchange, key, val, append(opts[:len(opts):len(opts)], WithContentType(ContentTypeGob))...)
 }
 
 type SimpleQueueType int
@@ -27,36 +121,79 @@ type AckType int
 const (
 	Durable   SimpleQueueType = 1
 	Transient SimpleQueueType = 2
+	// Quorum is a durable queue replicated across the cluster. It counts
+	// redeliveries, and with a delivery limit dead-letters messages that
+	// keep coming back.
+	Quorum SimpleQueueType = 3
+	// Stream is an append-only log that keeps messages after they are
+	// consumed. Subscribers read it from the offset given by
+	// WithStreamOffset.
+	Stream SimpleQueueType = 4
 )
 
 const (
-	Ack				AckType = iota
-	NackRequeue		
-	NackDiscard		
+	Ack AckType = iota
+	NackRequeue
+	NackDiscard
+	// RetryLater acks the message and redelivers it after a delay, see
+	// RetryPolicy.
+	RetryLater
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case RetryLater:
+		return "retry-later"
+	}
+	return fmt.Sprintf("AckType(%d)", int(a))
+}
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
+	return declareAndBind(ctx, conn, exchange, queueName, key, queueType, newQueueOptions(queueName, opts))
+}
+
+func declareAndBind(
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
+	qo QueueOptions,
+) (Channel, amqp.Queue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, amqp.Queue{}, err
+	}
+	args, err := queueArgs(queueType, qo)
+	if err != nil {
+		return nil, amqp.Queue{}, err
+	}
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not create channel: %v", err)
 	}
 
 	queue, err := ch.QueueDeclare(
-		queueName,                       // name
-		queueType == Durable, // durable
-		queueType != Durable, // delete when unused
-		queueType != Durable, // exclusive
-		false,                           // no-wait
-		amqp.Table{
-			"x-dead-letter-exchange": "peril_dlx",
-		},                             // args
+		queueName,              // name
+		queueType != Transient, // durable
+		queueType == Transient, // delete when unused
+		queueType == Transient, // exclusive
+		false,                  // no-wait
+		args,                   // args
 	)
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
@@ -75,125 +212,221 @@ func DeclareAndBind(
 	return ch, queue, nil
 }
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// Subscribe consumes queueName and decodes each delivery with the codec
+// registered for its ContentType, so one queue can carry several encodings.
+// Deliveries without a ContentType fall back to WithDefaultContentType, then
+// to routing.ContentType of their routing key, then to JSON.
+func Subscribe[T any](
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
+	opts ...SubscribeOption,
+) (*Subscription, error) {
 	return subscribe[T](
+		ctx,
 		conn,
 		exchange,
 		queueName,
 		key,
 		queueType,
-		handler,
-		func(data []byte) (T, error) {
-			var target T
-			err := json.Unmarshal(data, &target)
-			return target, err
-		},
+		func(d Delivery[T]) AckType { return handler(d.Body) },
+		opts...,
 	)
 }
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+// SubscribeDelivery is Subscribe for handlers that need the message's
+// envelope as well as its body.
+func SubscribeDelivery[T any](
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
+	handler func(Delivery[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
 	return subscribe[T](
+		ctx,
 		conn,
 		exchange,
 		queueName,
 		key,
 		queueType,
 		handler,
-		func(data []byte) (T, error) {
-			buffer := bytes.NewBuffer(data)
-			decoder := gob.NewDecoder(buffer)
-			var target T
-			err := decoder.Decode(&target)
-			return target, err
-		},
+		opts...,
 	)
 }
 
-func subscribe[T any](
-	conn *amqp.Connection,
+func SubscribeJSON[T any](
+	ctx context.Context,
+	conn Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultContentType(ContentTypeJSON)}, opts...)
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, opts...)
+}
+
+func SubscribeGob[T any](
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append([]SubscribeOption{WithDefaultContentType(ContentTypeGob)}, opts...)
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, opts...)
+}
+
+func subscribe[T any](
+	ctx context.Context,
+	conn Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Delivery[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	cfg := newSubscribeOptions(opts)
+	if err := cfg.check(queueType); err != nil {
+		return nil, err
+	}
+	ch, queue, err := DeclareAndBind(ctx, conn, exchange, queueName, key, queueType, cfg.Queue...)
 	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
+		return nil, fmt.Errorf("could not declare and bind queue: %v", err)
 	}
 
-	err = ch.Qos(10, 0, false)
+	err = ch.Qos(cfg.PrefetchCount, cfg.PrefetchSize, false)
 	if err != nil {
-		return fmt.Errorf("error while qos: %w", err)
+		ch.Close()
+		return nil, fmt.Errorf("error while qos: %w", err)
 	}
 
+	tag := cfg.ConsumerTag
+	if tag == "" {
+		tag = consumerTag(queue.Name)
+	}
+	args := amqp.Table{}
+	if cfg.Priority != 0 {
+		args["x-priority"] = cfg.Priority
+	}
+	if cfg.StreamOffset.value != nil {
+		args["x-stream-offset"] = cfg.StreamOffset.value
+	}
 	msgs, err := ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
+		queue.Name,    // queue
+		tag,           // consumer
+		cfg.AutoAck,   // auto-ack
+		cfg.Exclusive, // exclusive
+		false,         // no-local
+		false,         // no-wait
+		args,          // args
 	)
 	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
+		ch.Close()
+		return nil, fmt.Errorf("could not consume messages: %v", err)
 	}
 
-	go func() {
-		defer ch.Close()
-		for msg := range msgs {
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-				continue
-			}
-			switch handler(target) {
-			case Ack:
-				msg.Ack(false)
-			case NackDiscard:
-				msg.Nack(false, false)
-			case NackRequeue:
-				msg.Nack(false, true)
-			}
+	// retries and dead-lettered decode failures are published on their own
+	// channel, which is safe to share between workers, and the original is
+	// only acked once the broker has them
+	pub, err := NewConfirmPublisher(conn, ConfirmOptions{})
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	retrier := newRetrier(conn, pub, queue.Name, queueType != Transient, cfg.Retry)
+	sub := newSubscription(ch, tag)
+	var h Handler = func(ctx context.Context, msg amqp.Delivery) AckType {
+		contentType := msg.ContentType
+		if contentType == "" {
+			contentType = contentTypeFor(cfg.DefaultContentType, msg.RoutingKey)
 		}
+		target, err := decode[T](contentType, msg.ContentEncoding, msg.Body)
+		if err != nil {
+			return handleDecodeError(ctx, pub, cfg.OnDecodeError, DecodeFailure{
+				Delivery: msg,
+				Queue:    queue.Name,
+				Codec:    contentType,
+				Err:      err,
+			})
+		}
+		return handler(newDelivery(ctx, msg, target))
+	}
+	h = Chain(cfg.Middleware...)(h)
+	delivered := deliveredTotal.WithLabelValues(queue.Name)
+	handle := func(msg amqp.Delivery) {
+		delivered.Inc()
+		ctx, span := startProcess(ctx, queue.Name, msg)
+		start := time.Now()
+		ack := h(ctx, msg)
+		observeHandled(queue.Name, ack, time.Since(start))
+		if queueType == Stream {
+			// a stream keeps the message whatever happens, acking it only
+			// moves this consumer on
+			ack = Ack
+		}
+		if ack == RetryLater {
+			ack = retrier.retry(ctx, msg)
+		}
+		if !cfg.AutoAck {
+			settle(msg, ack)
+		}
+		endProcess(span, ack)
+	}
+	go func() {
+		defer close(sub.done)
+		defer pub.Close()
+		dispatch(sub.stop, msgs, cfg.Workers, cfg.PrefetchCount, cfg.OrderBy, handle)
 	}()
-	return nil
+	go sub.closeOnDone(ctx)
+	return sub, nil
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	dat, err := encode(val)
-	if err != nil {
-		return err
+func settle(msg amqp.Delivery, ack AckType) {
+	switch ack {
+	case Ack:
+		msg.Ack(false)
+	case NackDiscard:
+		msg.Nack(false, false)
+	case NackRequeue, RetryLater:
+		msg.Nack(false, true)
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        dat,
-	})
 }
 
+func contentTypeFor(contentType, key string) string {
+	if contentType != "" {
+		return contentType
+	}
+	if contentType = routing.ContentType(key); contentType != "" {
+		return contentType
+	}
+	return ContentTypeJSON
+}
 
-func encode[T any](val T) ([]byte, error) {
-	// ?
-	var network bytes.Buffer
-	enc := gob.NewEncoder(&network)
-	if err := enc.Encode(val); err != nil {
-		return nil, err
+func decode[T any](contentType, encoding string, data []byte) (T, error) {
+	var target T
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return target, err
 	}
-	return network.Bytes(), nil
-}
\ No newline at end of file
+	data, err = Decompress(encoding, data)
+	if err != nil {
+		return target, fmt.Errorf("could not decompress %s body: %w", encoding, err)
+	}
+	err = codec.Unmarshal(data, &target)
+	return target, err
+}
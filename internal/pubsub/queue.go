@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type QueueOption func(*QueueOptions)
+
+// QueueOptions are the arguments DeclareAndBind declares a queue with,
+// starting from routing.QueueLimitsFor its name. A queue that already
+// exists must have been declared with the same ones.
+type QueueOptions routing.QueueLimits
+
+func newQueueOptions(queue string, opts []QueueOption) QueueOptions {
+	o := QueueOptions(routing.QueueLimitsFor(queue))
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMessageTTL dead-letters messages that have waited in the queue for
+// ttl. 0 removes the limit.
+func WithMessageTTL(ttl time.Duration) QueueOption {
+	return func(o *QueueOptions) {
+		o.MessageTTL = ttl
+	}
+}
+
+// WithExpires deletes the queue once it has gone unused for d.
+func WithExpires(d time.Duration) QueueOption {
+	return func(o *QueueOptions) {
+		o.Expires = d
+	}
+}
+
+// WithMaxLength caps the queue at n messages and size bytes, see
+// WithOverflow. 0 removes a limit.
+func WithMaxLength(n, size int) QueueOption {
+	return func(o *QueueOptions) {
+		o.MaxLength, o.MaxLengthBytes = n, size
+	}
+}
+
+// WithOverflow picks what a full queue does, one of routing's Overflow
+// constants.
+func WithOverflow(overflow string) QueueOption {
+	return func(o *QueueOptions) {
+		o.Overflow = overflow
+	}
+}
+
+func WithDeliveryLimit(n int) QueueOption {
+	return func(o *QueueOptions) {
+		o.DeliveryLimit = n
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with opts.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Queue = append(o.Queue, opts...)
+	}
+}
+
+func queueArgs(queueType SimpleQueueType, o QueueOptions) (amqp.Table, error) {
+	var errs []error
+	if o.DeliveryLimit != 0 && queueType != Quorum {
+		errs = append(errs, errors.New("a delivery limit needs a quorum queue"))
+	}
+	switch o.Overflow {
+	case "", routing.OverflowDropHead, routing.OverflowRejectPublish:
+	case routing.OverflowRejectPublishDLX:
+		if queueType == Quorum {
+			errs = append(errs, errors.New("quorum queues do not support reject-publish-dlx"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown overflow %q", o.Overflow))
+	}
+	if queueType == Stream && (o.MessageTTL != 0 || o.Expires != 0 || o.MaxLength != 0 || o.Overflow != "") {
+		errs = append(errs, errors.New("streams only take a max length in bytes"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	var args amqp.Table
+	switch queueType {
+	case Stream:
+		// streams do not dead-letter
+		args = amqp.Table{"x-queue-type": "stream"}
+	case Quorum:
+		args = amqp.Table{
+			"x-dead-letter-exchange": routing.ExchangePerilDLX,
+			"x-queue-type":           "quorum",
+		}
+	case Durable, Transient:
+		args = amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDLX}
+	default:
+		return nil, fmt.Errorf("unknown queue type %d", queueType)
+	}
+	if o.DeliveryLimit != 0 {
+		args["x-delivery-limit"] = int64(o.DeliveryLimit)
+	}
+	if o.MessageTTL != 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.Expires != 0 {
+		args["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.MaxLength != 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.MaxLengthBytes != 0 {
+		args["x-max-length-bytes"] = int64(o.MaxLengthBytes)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = o.Overflow
+	}
+	return args, nil
+}
+
+// StreamOffset is where a subscriber starts reading a Stream queue.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	// StreamFirst reads from the oldest message the stream still has.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast reads from the last chunk of messages written.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext reads only messages written from now on. It is the
+	// default.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamAt reads from the message at offset.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// StreamSince reads from the first chunk of messages written at or after t.
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.StreamOffset = offset
+	}
+}
+
+// check rejects options that do not work with queueType.
+func (o SubscribeOptions) check(queueType SimpleQueueType) error {
+	if queueType == Stream {
+		if o.AutoAck {
+			return errors.New("a stream can not be consumed with auto-ack")
+		}
+		if o.PrefetchCount == 0 {
+			return errors.New("a stream needs a prefetch count")
+		}
+	} else if o.StreamOffset.value != nil {
+		return errors.New("a stream offset needs a stream queue")
+	}
+	return nil
+}
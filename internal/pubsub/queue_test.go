@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueArgs(t *testing.T) {
+	dlx := routing.ExchangePerilDLX
+	tests := []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      QueueOptions
+		// nil when the options are refused
+		want amqp.Table
+	}{
+		{"durable", Durable, QueueOptions{}, amqp.Table{"x-dead-letter-exchange": dlx}},
+		{"limits", Transient, QueueOptions{
+			MessageTTL:     1500 * time.Millisecond,
+			Expires:        time.Minute,
+			MaxLength:      10,
+			MaxLengthBytes: 1 << 10,
+			Overflow:       routing.OverflowRejectPublishDLX,
+		}, amqp.Table{
+			"x-dead-letter-exchange": dlx,
+			"x-message-ttl":          int64(1500),
+			"x-expires":              int64(60_000),
+			"x-max-length":           int64(10),
+			"x-max-length-bytes":     int64(1 << 10),
+			"x-overflow":             routing.OverflowRejectPublishDLX,
+		}},
+		{"quorum with a delivery limit", Quorum, QueueOptions{DeliveryLimit: 5}, amqp.Table{
+			"x-dead-letter-exchange": dlx,
+			"x-queue-type":           "quorum",
+			"x-delivery-limit":       int64(5),
+		}},
+		{"delivery limit on a classic queue", Durable, QueueOptions{DeliveryLimit: 5}, nil},
+		{"quorum with reject-publish", Quorum, QueueOptions{MaxLength: 1, Overflow: routing.OverflowRejectPublish}, amqp.Table{
+			"x-dead-letter-exchange": dlx,
+			"x-queue-type":           "quorum",
+			"x-max-length":           int64(1),
+			"x-overflow":             routing.OverflowRejectPublish,
+		}},
+		{"quorum with reject-publish-dlx", Quorum, QueueOptions{MaxLength: 1, Overflow: routing.OverflowRejectPublishDLX}, nil},
+		{"unknown overflow", Durable, QueueOptions{MaxLength: 1, Overflow: "drop-tail"}, nil},
+		{"stream", Stream, QueueOptions{MaxLengthBytes: 1 << 20}, amqp.Table{
+			"x-queue-type":       "stream",
+			"x-max-length-bytes": int64(1 << 20),
+		}},
+		{"stream with a ttl", Stream, QueueOptions{MessageTTL: time.Second}, nil},
+		{"stream with an expiry", Stream, QueueOptions{Expires: time.Second}, nil},
+		{"stream with a max length", Stream, QueueOptions{MaxLength: 10}, nil},
+		{"stream with an overflow", Stream, QueueOptions{Overflow: routing.OverflowDropHead}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queueArgs(tt.queueType, tt.opts)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("accepted as %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueArgsJoinsErrors(t *testing.T) {
+	_, err := queueArgs(Stream, QueueOptions{DeliveryLimit: 1, MessageTTL: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "quorum") || !strings.Contains(err.Error(), "stream") {
+		t.Errorf("got %v, want both problems", err)
+	}
+}
+
+func TestNewQueueOptions(t *testing.T) {
+	tests := []struct {
+		queue string
+		opts  []QueueOption
+		want  QueueOptions
+	}{
+		{"pause.alice", nil, QueueOptions{}},
+		{routing.ArmyMovesPrefix + ".alice", nil, QueueOptions{MaxLength: 10_000}},
+		{routing.WarRecognitionsPrefix, nil, QueueOptions{
+			MaxLength:     10_000,
+			Overflow:      routing.OverflowRejectPublish,
+			DeliveryLimit: 10,
+		}},
+		{routing.GameLogSlug, nil, QueueOptions{
+			MaxLength:      100_000,
+			MaxLengthBytes: 64 << 20,
+			Overflow:       routing.OverflowRejectPublish,
+			DeliveryLimit:  10,
+		}},
+		{routing.PresencePrefix + ".alice", nil, QueueOptions{MessageTTL: routing.PresenceInterval}},
+		{routing.RPCPrefix + ".online_players", nil, QueueOptions{MessageTTL: 10 * time.Second}},
+		// the audit stream is not an army_moves queue
+		{routing.QueueArmyMovesAudit, nil, QueueOptions{MaxLengthBytes: 1 << 30}},
+		// options apply over the defaults and leave the rest alone
+		{routing.WarRecognitionsPrefix, []QueueOption{
+			WithMaxLength(5, 0),
+			WithOverflow(routing.OverflowDropHead),
+			WithExpires(time.Hour),
+		}, QueueOptions{
+			MaxLength:     5,
+			Overflow:      routing.OverflowDropHead,
+			DeliveryLimit: 10,
+			Expires:       time.Hour,
+		}},
+		{routing.PresencePrefix + ".alice", []QueueOption{WithMessageTTL(0)}, QueueOptions{}},
+	}
+	for _, tt := range tests {
+		if got := newQueueOptions(tt.queue, tt.opts); got != tt.want {
+			t.Errorf("newQueueOptions(%q) = %+v, want %+v", tt.queue, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryBrokerOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		// what the queue holds and what was dead-lettered after publishing
+		// 1, 2 and 3 to a queue of two
+		queued, dead string
+		nacked       bool
+	}{
+		{routing.OverflowDropHead, "23", "1", false},
+		{routing.OverflowRejectPublish, "12", "", true},
+		{routing.OverflowRejectPublishDLX, "12", "3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			ctx := context.Background()
+			_, conn := newTestBroker(t)
+			ch, _, err := DeclareAndBind(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+				WithMaxLength(2, 0), WithOverflow(tt.overflow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+			pub, err := NewConfirmPublisher(conn, ConfirmOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pub.Close()
+
+			for i, body := range "123" {
+				err := pub.PublishWithContext(ctx, routing.ExchangePerilDirect, routing.PauseKey, false, false, amqp.Publishing{Body: []byte(string(body))})
+				var nack *NackError
+				if nacked := errors.As(err, &nack); nacked != (tt.nacked && i == 2) {
+					t.Errorf("publish %c: %v", body, err)
+				}
+			}
+
+			var queued, dead string
+			for {
+				msg, ok, err := ch.Get("pause.test", true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					break
+				}
+				queued += string(msg.Body)
+			}
+			for _, dl := range deadLetters(t, conn) {
+				dead += string(dl.Delivery.Body)
+				if dl.Reason != "maxlen" {
+					t.Errorf("dead-lettered %s for %s", dl.Delivery.Body, dl.Reason)
+				}
+			}
+			if queued != tt.queued || dead != tt.dead {
+				t.Errorf("queued %q and dead-lettered %q, want %q and %q", queued, dead, tt.queued, tt.dead)
+			}
+		})
+	}
+}
@@ -0,0 +1,646 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type PublishMode int
+
+const (
+	// PublishBlock makes publishes wait until the connection is back.
+	PublishBlock PublishMode = iota
+	// PublishBuffer queues publishes made during an outage and sends them
+	// once the connection is back. Channels in confirm mode, and so
+	// ConfirmPublisher and PublisherPool, always wait instead, as a buffered
+	// message can not be confirmed.
+	PublishBuffer
+)
+
+var ErrPublishBufferFull = errors.New("publish buffer is full")
+
+type ReconnectOptions struct {
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	PublishMode PublishMode
+	BufferSize  int
+}
+
+func (o ReconnectOptions) withDefaults() ReconnectOptions {
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = 1000
+	}
+	return o
+}
+
+// closeNotifier is implemented by brokers that report an unexpected loss of
+// their connection, like *amqp.Connection does.
+type closeNotifier interface {
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+}
+
+// ManagedConn is a Broker that survives connection loss. It redials with
+// exponential backoff, re-declares every exchange, queue and binding that was
+// declared through it, and re-attaches consumers, so subscriptions keep
+// running across broker restarts.
+type ManagedConn struct {
+	dial func() (Broker, error)
+	opts ReconnectOptions
+
+	mu       sync.Mutex
+	conn     Broker
+	ready    chan struct{}
+	done     chan struct{}
+	closed   bool
+	topology []string
+	declares map[string]func(Channel) error
+	pending  chan pendingPublish
+}
+
+type pendingPublish struct {
+	exchange  string
+	key       string
+	mandatory bool
+	immediate bool
+	msg       amqp.Publishing
+}
+
+func DialManaged(url string, opts ReconnectOptions) (*ManagedConn, error) {
+	return NewManagedConn(func() (Broker, error) { return Dial(url) }, opts)
+}
+
+func NewManagedConn(dial func() (Broker, error), opts ReconnectOptions) (*ManagedConn, error) {
+	opts = opts.withDefaults()
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(closeNotifier); !ok {
+		conn.Close()
+		return nil, fmt.Errorf("broker %T does not support close notifications", conn)
+	}
+	notify := notifyClose(conn)
+
+	mc := &ManagedConn{
+		dial:     dial,
+		opts:     opts,
+		conn:     conn,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		declares: map[string]func(Channel) error{},
+		pending:  make(chan pendingPublish, opts.BufferSize),
+	}
+	close(mc.ready)
+	go mc.watch(notify)
+	return mc, nil
+}
+
+// notifyClose registers for conn's close before it is handed out, so that
+// losing it at any point afterwards is noticed. A connection that is already
+// gone closes the returned channel straight away.
+func notifyClose(conn Broker) chan *amqp.Error {
+	return conn.(closeNotifier).NotifyClose(make(chan *amqp.Error, 1))
+}
+
+func (mc *ManagedConn) Channel() (Channel, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		return nil, amqp.ErrClosed
+	}
+	return &managedChannel{
+		mc:        mc,
+		done:      make(chan struct{}),
+		cancelled: map[string]bool{},
+	}, nil
+}
+
+func (mc *ManagedConn) Close() error {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	mc.closed = true
+	close(mc.done)
+	conn := mc.conn
+	mc.mu.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (mc *ManagedConn) watch(notify chan *amqp.Error) {
+	for {
+		select {
+		case <-mc.done:
+			return
+		case reason := <-notify:
+			mc.mu.Lock()
+			closed := mc.closed
+			mc.mu.Unlock()
+			if closed {
+				return
+			}
+			// reason is nil if the connection was gone before we asked
+			slog.Warn("connection lost", "error", reason)
+		}
+
+		mc.lost(nil)
+		notify = mc.reconnect()
+		if notify == nil {
+			return
+		}
+	}
+}
+
+// reconnect redials until it succeeds or mc is closed, and returns the new
+// connection's close notifications.
+func (mc *ManagedConn) reconnect() chan *amqp.Error {
+	backoff := mc.opts.MinBackoff
+	for {
+		select {
+		case <-mc.done:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := mc.dial()
+		var notify chan *amqp.Error
+		if err == nil {
+			notify = notifyClose(conn)
+			err = mc.redeclare(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			backoff = min(backoff*2, mc.opts.MaxBackoff)
+			slog.Warn("reconnect failed", "backoff", backoff, "error", err)
+			continue
+		}
+
+		mc.mu.Lock()
+		if mc.closed {
+			mc.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		mc.conn = conn
+		close(mc.ready)
+		mc.mu.Unlock()
+
+		slog.Info("reconnected")
+		go mc.flush()
+		return notify
+	}
+}
+
+func (mc *ManagedConn) redeclare(conn Broker) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	mc.mu.Lock()
+	declares := make([]func(Channel) error, 0, len(mc.topology))
+	for _, key := range mc.topology {
+		declares = append(declares, mc.declares[key])
+	}
+	mc.mu.Unlock()
+
+	for _, declare := range declares {
+		if err := declare(ch); err != nil {
+			return fmt.Errorf("could not redeclare topology: %w", err)
+		}
+	}
+	return nil
+}
+
+func (mc *ManagedConn) remember(key string, declare func(Channel) error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if _, ok := mc.declares[key]; !ok {
+		mc.topology = append(mc.topology, key)
+	}
+	mc.declares[key] = declare
+}
+
+// lost marks conn as gone, so callers wait for the reconnect, unless it has
+// been replaced already. A nil conn is whichever one is current.
+func (mc *ManagedConn) lost(conn Broker) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.conn != nil && (conn == nil || mc.conn == conn) {
+		mc.conn = nil
+		mc.ready = make(chan struct{})
+	}
+}
+
+// current returns the live connection and its ready channel, waiting for a
+// reconnect if the connection is down.
+func (mc *ManagedConn) current(ctx context.Context) (Broker, chan struct{}, error) {
+	for {
+		mc.mu.Lock()
+		if mc.closed {
+			mc.mu.Unlock()
+			return nil, nil, amqp.ErrClosed
+		}
+		conn, ready := mc.conn, mc.ready
+		mc.mu.Unlock()
+		if conn != nil {
+			return conn, ready, nil
+		}
+
+		select {
+		case <-ready:
+		case <-mc.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (mc *ManagedConn) isCurrent(ready chan struct{}) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.conn != nil && mc.ready == ready
+}
+
+func (mc *ManagedConn) connected() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.conn != nil
+}
+
+func (mc *ManagedConn) flush() {
+	ch, err := mc.Channel()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for {
+		select {
+		case p := <-mc.pending:
+			err := ch.PublishWithContext(context.Background(), p.exchange, p.key, p.mandatory, p.immediate, p.msg)
+			if err != nil {
+				slog.Error("could not flush buffered publish", "exchange", p.exchange, "routing_key", p.key, "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+type managedChannel struct {
+	mc *ManagedConn
+
+	mu     sync.Mutex
+	ch     Channel
+	ready  chan struct{}
+	qos    func(Channel) error
+	pinned bool
+	closed bool
+	done   chan struct{}
+
+	cancelled map[string]bool
+}
+
+// channel returns an open channel on the current connection, reopening it
+// after a reconnect. Channels in confirm mode are never reopened, because
+// delivery tags restart on a new channel; callers open a fresh one instead.
+func (c *managedChannel) channel(ctx context.Context) (Channel, error) {
+	c.mu.Lock()
+	pinned, ch, ready := c.pinned, c.ch, c.ready
+	c.mu.Unlock()
+	if pinned {
+		if ch == nil || !c.mc.isCurrent(ready) {
+			return nil, amqp.ErrClosed
+		}
+		return ch, nil
+	}
+
+	for {
+		ch, conn, err := c.open(ctx)
+		if conn == nil || !errors.Is(err, amqp.ErrClosed) {
+			return ch, err
+		}
+		// the connection died before watch heard about it
+		c.mc.lost(conn)
+	}
+}
+
+// open returns the channel on the current connection, opening one if need
+// be. If opening fails it also returns the connection it tried.
+func (c *managedChannel) open(ctx context.Context) (Channel, Broker, error) {
+	conn, ready, err := c.mc.current(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, amqp.ErrClosed
+	}
+	if c.ch != nil && c.ready == ready {
+		return c.ch, nil, nil
+	}
+	if c.ch != nil {
+		c.ch.Close()
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, conn, err
+	}
+	if c.qos != nil {
+		if err := c.qos(ch); err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+	}
+	c.ch, c.ready = ch, ready
+	return ch, nil, nil
+}
+
+// reset drops the current channel so the next call opens a fresh one.
+func (c *managedChannel) reset(ch Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil && c.ch == ch {
+		c.ch.Close()
+		c.ch = nil
+	}
+}
+
+func (c *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	for {
+		if c.mc.opts.PublishMode == PublishBuffer && !c.mc.connected() && !c.isPinned() {
+			select {
+			case c.mc.pending <- pendingPublish{exchange, key, mandatory, immediate, msg}:
+				return nil
+			default:
+				return ErrPublishBufferFull
+			}
+		}
+
+		ch, err := c.channel(ctx)
+		if err != nil {
+			return err
+		}
+		err = ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+		if !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		c.reset(ch)
+		if c.mc.connected() {
+			return err
+		}
+		// the connection dropped under us, wait for it to come back
+	}
+}
+
+func (c *managedChannel) isPinned() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pinned
+}
+
+func (c *managedChannel) Confirm(noWait bool) error {
+	return c.confirm(context.Background(), noWait)
+}
+
+// confirm is Confirm giving up on waiting for a reconnect when ctx ends.
+func (c *managedChannel) confirm(ctx context.Context, noWait bool) error {
+	ch, err := c.channel(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(noWait); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pinned = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *managedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		close(confirm)
+		return confirm
+	}
+	return ch.NotifyPublish(confirm)
+}
+
+func (c *managedChannel) NotifyReturn(r chan amqp.Return) chan amqp.Return {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		close(r)
+		return r
+	}
+	return ch.NotifyReturn(r)
+}
+
+func (c *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	declare := func(ch Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	}
+	return c.declare("exchange:"+name, declare)
+}
+
+func (c *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	queue, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	if name != "" {
+		c.mc.remember("queue:"+name, func(ch Channel) error {
+			_, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+			return err
+		})
+	}
+	return queue, nil
+}
+
+func (c *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	declare := func(ch Channel) error {
+		return ch.QueueBind(name, key, exchange, noWait, args)
+	}
+	return c.declare("bind:"+name+"|"+key+"|"+exchange, declare)
+}
+
+func (c *managedChannel) declare(key string, declare func(Channel) error) error {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := declare(ch); err != nil {
+		return err
+	}
+	c.mc.remember(key, declare)
+	return nil
+}
+
+func (c *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	qos := func(ch Channel) error {
+		return ch.Qos(prefetchCount, prefetchSize, global)
+	}
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := qos(ch); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.qos = qos
+	c.mu.Unlock()
+	return nil
+}
+
+// Consume returns a delivery channel that stays open across reconnects: when
+// the underlying consumer goes away it is re-created on a fresh channel.
+func (c *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	consume := func(args amqp.Table) (Channel, <-chan amqp.Delivery, error) {
+		ch, err := c.channel(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs, err := ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+		if err != nil {
+			c.reset(ch)
+			return nil, nil, err
+		}
+		return ch, msgs, nil
+	}
+
+	ch, msgs, err := consume(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// a stream consumer picks up after the last message it passed on,
+	// rather than at the offset it first asked for
+	var streamNext int64
+	resume := false
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		backoff := c.mc.opts.MinBackoff
+		for {
+			for msg := range msgs {
+				select {
+				case out <- msg:
+				case <-c.done:
+					return
+				}
+				if offset, ok := tableInt(msg.Headers, "x-stream-offset"); ok {
+					streamNext, resume = offset+1, true
+				}
+			}
+			if c.isCancelled(consumer) {
+				return
+			}
+			c.reset(ch)
+
+			for {
+				select {
+				case <-c.done:
+					return
+				case <-c.mc.done:
+					return
+				case <-time.After(backoff):
+				}
+				if c.isCancelled(consumer) {
+					return
+				}
+				reattach := args
+				if resume {
+					reattach = amqp.Table{}
+					for k, v := range args {
+						reattach[k] = v
+					}
+					reattach["x-stream-offset"] = streamNext
+				}
+				ch, msgs, err = consume(reattach)
+				if err == nil {
+					backoff = c.mc.opts.MinBackoff
+					break
+				}
+				backoff = min(backoff*2, c.mc.opts.MaxBackoff)
+				slog.Warn("could not re-attach consumer", "queue", queue, "backoff", backoff, "error", err)
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (c *managedChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	return ch.Get(queue, autoAck)
+}
+
+func (c *managedChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch, err := c.channel(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return ch.QueuePurge(name, noWait)
+}
+
+func (c *managedChannel) Cancel(consumer string, noWait bool) error {
+	c.mu.Lock()
+	c.cancelled[consumer] = true
+	ch := c.ch
+	c.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	return ch.Cancel(consumer, noWait)
+}
+
+func (c *managedChannel) isCancelled(consumer string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled[consumer]
+}
+
+func (c *managedChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	if c.ch != nil {
+		c.ch.Close()
+		c.ch = nil
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestManagedConnRedeclares(t *testing.T) {
+	ctx := context.Background()
+	b, conn := newTestBroker(t)
+	mc := newManagedTestConn(t, b)
+	ch, err := mc.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	// nothing transient survives a restart unless it is declared again
+	if err := ch.ExchangeDeclare("test.transient", amqp.ExchangeDirect, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DeclareAndBind(ctx, mc, "test.transient", "test.queue", "key", Transient); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := NewConfirmPublisher(conn, ConfirmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	routed := func() bool {
+		err := pub.PublishWithContext(ctx, "test.transient", "key", true, false, amqp.Publishing{})
+		return err == nil
+	}
+	if !routed() {
+		t.Fatal("not routed before the restart")
+	}
+
+	b.Restart()
+	pub, err = NewConfirmPublisher(b.Connect(), ConfirmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	eventually(t, routed)
+}
+
+func TestManagedConnReattachesConsumers(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBroker(t)
+	mc := newManagedTestConn(t, b)
+
+	got := make(chan routing.PlayingState, 10)
+	sub, err := Subscribe(ctx, mc, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType {
+			got <- ps
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	testPublish(t, b.Connect(), routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	receive(t, got)
+	b.Restart()
+	// the queue is durable, so the message waits for the consumer to return
+	testPublish(t, b.Connect(), routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	if ps := receive(t, got); !ps.IsPaused {
+		t.Errorf("got %+v", ps)
+	}
+	expectNone(t, got)
+}
+
+func TestManagedConnPublishMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode PublishMode
+	}{
+		{"block", PublishBlock},
+		{"buffer", PublishBuffer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			b, conn := newTestBroker(t)
+			var down atomic.Bool
+			mc, err := NewManagedConn(func() (Broker, error) {
+				if down.Load() {
+					return nil, errors.New("connection refused")
+				}
+				return b.Connect(), nil
+			}, ReconnectOptions{
+				MinBackoff:  10 * time.Millisecond,
+				MaxBackoff:  20 * time.Millisecond,
+				PublishMode: tt.mode,
+				BufferSize:  1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mc.Close()
+
+			got := make(chan routing.PlayingState, 10)
+			sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+				func(ps routing.PlayingState) AckType {
+					got <- ps
+					return Ack
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			ch, err := mc.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+
+			down.Store(true)
+			b.Restart()
+			eventually(t, func() bool { return !mc.connected() })
+
+			published := make(chan error, 1)
+			switch tt.mode {
+			case PublishBlock:
+				shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				err := Publish(shortCtx, ch, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{})
+				cancel()
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("publish during the outage: %v", err)
+				}
+				go func() {
+					published <- Publish(ctx, ch, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+				}()
+				expectNone(t, published)
+			case PublishBuffer:
+				if err := Publish(ctx, ch, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true}); err != nil {
+					t.Fatalf("publish during the outage: %v", err)
+				}
+				err := Publish(ctx, ch, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{})
+				if !errors.Is(err, ErrPublishBufferFull) {
+					t.Fatalf("publish to a full buffer: %v", err)
+				}
+				published <- nil
+			}
+
+			// the subscriber's own connection died in the restart too
+			sub.Close()
+			sub, err = Subscribe(ctx, b.Connect(), routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+				func(ps routing.PlayingState) AckType {
+					got <- ps
+					return Ack
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			down.Store(false)
+			if err := receive(t, published); err != nil {
+				t.Fatalf("publish once reconnected: %v", err)
+			}
+			if ps := receive(t, got); !ps.IsPaused {
+				t.Errorf("got %+v", ps)
+			}
+			expectNone(t, got)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderAttempt counts how many times a message has been retried.
+const HeaderAttempt = "x-peril-attempt"
+
+// RetryPolicy controls what happens when a handler returns RetryLater. The
+// message is parked in a per-delay retry queue whose TTL dead-letters it back
+// to the original queue. The n-th retry waits Delays[n-1], reusing the last
+// delay once they run out, and after MaxAttempts retries the message is moved
+// to the queue's parking lot instead.
+type RetryPolicy struct {
+	Delays      []time.Duration
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Delays:      []time.Duration{time.Second, 5 * time.Second, 30 * time.Second},
+	MaxAttempts: 5,
+}
+
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Retry = policy
+	}
+}
+
+func RetryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+func ParkingLotQueueName(queue string) string {
+	return queue + ".parking-lot"
+}
+
+type retrier struct {
+	conn    Broker
+	pub     Publisher
+	queue   string
+	durable bool
+	policy  RetryPolicy
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+// newRetrier declares retry queues on short-lived channels from conn and
+// publishes to them with pub, which should confirm them.
+func newRetrier(conn Broker, pub Publisher, queue string, durable bool, policy RetryPolicy) *retrier {
+	if len(policy.Delays) == 0 {
+		policy.Delays = DefaultRetryPolicy.Delays
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	return &retrier{
+		conn:     conn,
+		pub:      pub,
+		queue:    queue,
+		durable:  durable,
+		policy:   policy,
+		declared: map[string]bool{},
+	}
+}
+
+// retry moves msg to the retry queue for its next attempt, or to the parking
+// lot once it is out of attempts, and returns how to settle the original.
+func (r *retrier) retry(ctx context.Context, msg amqp.Delivery) AckType {
+	attempt := 1
+	if n, ok := tableInt(msg.Headers, HeaderAttempt); ok {
+		attempt = int(n) + 1
+	}
+
+	target := ParkingLotQueueName(r.queue)
+	var args amqp.Table
+	durable := true
+	if attempt <= r.policy.MaxAttempts {
+		delay := r.policy.Delays[min(attempt, len(r.policy.Delays))-1]
+		target = RetryQueueName(r.queue, delay)
+		args = amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": r.queue,
+		}
+		durable = r.durable
+		if !durable {
+			// nothing consumes a retry queue, so a transient one cleans
+			// itself up once it has sat empty for a while
+			args["x-expires"] = (delay + time.Minute).Milliseconds()
+		}
+	}
+
+	if err := r.declare(target, durable, args); err != nil {
+		slog.Error("could not declare retry queue", "queue", target, "error", err)
+		return NackRequeue
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderAttempt] = int32(attempt)
+	if _, ok := headers[HeaderOriginalRoutingKey]; !ok {
+		headers[HeaderOriginalExchange] = msg.Exchange
+		headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	}
+
+	// mandatory, as a transient retry queue may have expired since it was
+	// declared
+	err := r.pub.PublishWithContext(ctx, "", target, true, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+	var returned *ReturnError
+	if errors.As(err, &returned) {
+		r.forget(target)
+	}
+	if err != nil {
+		slog.Error("could not publish retry",
+			"queue", target,
+			"routing_key", msg.RoutingKey,
+			"message_id", msg.MessageId,
+			"attempt", attempt,
+			"error", err)
+		return NackRequeue
+	}
+	return Ack
+}
+
+func (r *retrier) declare(name string, durable bool, args amqp.Table) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.declared[name] {
+		return nil
+	}
+	// a retry queue left over from a different policy fails the declare,
+	// and takes the channel with it
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %w", err)
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare(name, durable, false, false, false, args); err != nil {
+		return err
+	}
+	r.declared[name] = true
+	return nil
+}
+
+func (r *retrier) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.declared, name)
+}
@@ -0,0 +1,153 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Delays: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}, MaxAttempts: 3}
+	tests := []struct {
+		name      string
+		queueType SimpleQueueType
+		// the handler returns RetryLater this many times, then Ack
+		retries  int
+		parked   bool
+		attempts []int64
+	}{
+		{"succeeds after retrying", Durable, 2, false, []int64{0, 1, 2}},
+		{"parked after max attempts", Durable, 10, true, []int64{0, 1, 2, 3}},
+		{"transient queue", Transient, 10, true, []int64{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			_, conn := newTestBroker(t)
+
+			type handled struct {
+				Delivery[routing.PlayingState]
+				at time.Time
+			}
+			got := make(chan handled, 10)
+			n := 0
+			sub, err := SubscribeDelivery(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, tt.queueType,
+				func(d Delivery[routing.PlayingState]) AckType {
+					got <- handled{d, time.Now()}
+					n++
+					if n <= tt.retries {
+						return RetryLater
+					}
+					return Ack
+				},
+				WithRetry(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+			var last time.Time
+			for i, want := range tt.attempts {
+				d := receive(t, got)
+				attempt, _ := tableInt(d.Headers, HeaderAttempt)
+				if attempt != want {
+					t.Errorf("delivery %d: attempt %d, want %d", i, attempt, want)
+				}
+				if i > 0 {
+					delay := policy.Delays[min(i, len(policy.Delays))-1]
+					if waited := d.at.Sub(last); waited < delay {
+						t.Errorf("delivery %d: redelivered after %s, want at least %s", i, waited, delay)
+					}
+					if key, _ := d.Headers[HeaderOriginalRoutingKey].(string); key != routing.PauseKey {
+						t.Errorf("delivery %d: original routing key %q", i, key)
+					}
+				}
+				last = d.at
+			}
+			expectNone(t, got)
+			if !tt.parked {
+				return
+			}
+
+			ch, err := conn.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+			msg, ok, err := ch.Get(ParkingLotQueueName("pause.test"), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("nothing in the parking lot")
+			}
+			if attempt, _ := tableInt(msg.Headers, HeaderAttempt); attempt != int64(policy.MaxAttempts+1) {
+				t.Errorf("parked at attempt %d", attempt)
+			}
+		})
+	}
+}
+
+func TestRetryDeclaresOffConsumerChannel(t *testing.T) {
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+
+	got := make(chan routing.PlayingState, 10)
+	n := 0
+	sub, err := Subscribe(ctx, declareSpy{conn, t}, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType {
+			got <- ps
+			n++
+			if n == 1 {
+				return RetryLater
+			}
+			return Ack
+		},
+		WithRetry(RetryPolicy{Delays: []time.Duration{10 * time.Millisecond}, MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	receive(t, got)
+	receive(t, got)
+}
+
+// declareSpy fails the test when a queue is declared on a channel that is
+// consuming, which RabbitMQ closes if the declare is refused.
+type declareSpy struct {
+	Broker
+	t *testing.T
+}
+
+func (s declareSpy) Channel() (Channel, error) {
+	ch, err := s.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &spyChannel{Channel: ch, t: s.t}, nil
+}
+
+type spyChannel struct {
+	Channel
+	t         *testing.T
+	consuming atomic.Bool
+}
+
+func (c *spyChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.consuming.Store(true)
+	return c.Channel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func (c *spyChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if c.consuming.Load() {
+		c.t.Errorf("declared %s on a consuming channel", name)
+	}
+	return c.Channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
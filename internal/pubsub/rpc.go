@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderRPCError carries the error a Serve handler returned, in place of a
+// response body.
+const HeaderRPCError = "x-peril-rpc-error"
+
+// RemoteError is returned by Request when the server's handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// Request publishes req to exchange with key and waits for the reply of a
+// Serve handler, decoded as Resp. The reply comes back on an exclusive
+// callback queue that only lives for the duration of the call. Cancel ctx,
+// or give it a deadline, to stop waiting.
+func Request[Req, Resp any](ctx context.Context, conn Broker, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	ch, err := conn.Channel()
+	if err != nil {
+		return resp, fmt.Errorf("could not create channel: %w", err)
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return resp, fmt.Errorf("could not declare callback queue: %w", err)
+	}
+	tag := consumerTag("rpc")
+	replies, err := ch.Consume(queue.Name, tag, true, true, false, false, nil)
+	if err != nil {
+		return resp, fmt.Errorf("could not consume callback queue: %w", err)
+	}
+	defer ch.Cancel(tag, false)
+
+	id := newMessageID()
+	cfg := newPublishConfig(opts)
+	codec, err := CodecFor(contentTypeFor(cfg.contentType, key))
+	if err != nil {
+		return resp, err
+	}
+	body, err := codec.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		MessageId:   id,
+		ReplyTo:     queue.Name,
+		Body:        body,
+	}
+	stamp(ctx, &msg)
+	pubCtx, span := startPublish(ctx, exchange, key, &msg)
+	err = ch.PublishWithContext(pubCtx, exchange, key, cfg.mandatory, false, msg)
+	endSpan(span, err)
+	if err != nil {
+		return resp, fmt.Errorf("could not publish request: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case reply, ok := <-replies:
+			if !ok {
+				return resp, amqp.ErrClosed
+			}
+			if reply.CorrelationId != id {
+				continue
+			}
+			if remote, ok := reply.Headers[HeaderRPCError].(string); ok {
+				return resp, &RemoteError{Message: remote}
+			}
+			return decode[Resp](reply.ContentType, reply.ContentEncoding, reply.Body)
+		}
+	}
+}
+
+// Serve answers Requests sent to queueName. Each handler result is
+// published back to the request's reply queue; a handler error is sent as a
+// RemoteError instead. Requests without a reply queue are handled and
+// dropped.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	conn Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(context.Context, Delivery[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	// replies may be published from several workers at once
+	replyCh, err := NewPublisherPool(conn, PoolOptions{Size: max(newSubscribeOptions(opts).Workers, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := SubscribeDelivery(ctx, conn, exchange, queueName, key, queueType, func(d Delivery[Req]) AckType {
+		resp, err := handler(d.Context(ctx), d)
+		if d.ReplyTo == "" {
+			return Ack
+		}
+		if err := reply(ctx, replyCh, d.ReplyTo, d.MessageID, resp, err); err != nil {
+			slog.Error("could not reply to request", "reply_to", d.ReplyTo, "message_id", d.MessageID, "error", err)
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		replyCh.Close()
+		return nil, err
+	}
+	go func() {
+		<-sub.Done()
+		replyCh.Close()
+	}()
+	return sub, nil
+}
+
+func reply[Resp any](ctx context.Context, ch Publisher, replyTo, correlationID string, resp Resp, handlerErr error) error {
+	ctx = WithCorrelationID(ctx, correlationID)
+	if handlerErr == nil {
+		return Publish(ctx, ch, "", replyTo, resp)
+	}
+	msg := amqp.Publishing{
+		Headers: amqp.Table{HeaderRPCError: handlerErr.Error()},
+	}
+	stamp(ctx, &msg)
+	return ch.PublishWithContext(ctx, "", replyTo, false, false, msg)
+}
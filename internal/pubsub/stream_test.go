@@ -0,0 +1,207 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestStreamOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset StreamOffset
+		// the offsets delivered from the three messages published before
+		// subscribing, and then one more
+		want []int64
+	}{
+		{"first", StreamFirst, []int64{0, 1, 2, 3}},
+		{"last", StreamLast, []int64{2, 3}},
+		{"next", StreamNext, []int64{3}},
+		{"numeric", StreamAt(1), []int64{1, 2, 3}},
+		{"numeric past the end", StreamAt(10), []int64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			_, conn := newTestBroker(t)
+			publish := func() {
+				t.Helper()
+				testPublish(t, conn, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", routing.PlayingState{})
+			}
+			for range 3 {
+				publish()
+			}
+
+			got := make(chan int64, 10)
+			sub, err := SubscribeDelivery(ctx, conn, routing.ExchangePerilTopic,
+				routing.QueueArmyMovesAudit,
+				routing.ArmyMovesPrefix+".*",
+				Stream,
+				func(d Delivery[routing.PlayingState]) AckType {
+					got <- d.StreamOffset
+					return Ack
+				},
+				WithStreamOffset(tt.offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			publish()
+			for _, want := range tt.want {
+				if offset := receive(t, got); offset != want {
+					t.Errorf("got offset %d, want %d", offset, want)
+				}
+			}
+			expectNone(t, got)
+		})
+	}
+}
+
+func TestStreamForcesAck(t *testing.T) {
+	ctx := context.Background()
+	b, conn := newTestBroker(t)
+	for range 3 {
+		testPublish(t, conn, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", routing.PlayingState{})
+	}
+
+	// whatever the handler says, each message is acked: nothing is retried
+	// or dead-lettered and, with a prefetch of one, the stream moves on
+	got := make(chan int64, 10)
+	acks := []AckType{NackRequeue, NackDiscard, RetryLater}
+	sub, err := SubscribeDelivery(ctx, conn, routing.ExchangePerilTopic,
+		routing.QueueArmyMovesAudit,
+		routing.ArmyMovesPrefix+".*",
+		Stream,
+		func(d Delivery[routing.PlayingState]) AckType {
+			got <- d.StreamOffset
+			return acks[d.StreamOffset]
+		},
+		WithStreamOffset(StreamFirst),
+		WithPrefetch(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for want := range int64(3) {
+		if offset := receive(t, got); offset != want {
+			t.Errorf("got offset %d, want %d", offset, want)
+		}
+	}
+	expectNone(t, got)
+	if dls := deadLetters(t, conn); len(dls) != 0 {
+		t.Errorf("dead-lettered %d messages from a stream", len(dls))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range b.queues {
+		if strings.HasPrefix(name, routing.QueueArmyMovesAudit+".") {
+			t.Errorf("declared %s for a stream", name)
+		}
+	}
+}
+
+func TestSubscribeOptionsCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      []SubscribeOption
+		ok        bool
+	}{
+		{"stream", Stream, nil, true},
+		{"stream with auto-ack", Stream, []SubscribeOption{WithAutoAck()}, false},
+		{"stream without prefetch", Stream, []SubscribeOption{WithPrefetch(0, 0)}, false},
+		{"stream offset", Stream, []SubscribeOption{WithStreamOffset(StreamAt(3))}, true},
+		{"stream offset on a durable queue", Durable, []SubscribeOption{WithStreamOffset(StreamFirst)}, false},
+		{"durable with auto-ack", Durable, []SubscribeOption{WithAutoAck()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newSubscribeOptions(tt.opts).check(tt.queueType)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestQuorumDeliveryLimit(t *testing.T) {
+	const limit = 2
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+
+	got := make(chan Delivery[routing.PlayingState], 10)
+	sub, err := SubscribeDelivery(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Quorum,
+		func(d Delivery[routing.PlayingState]) AckType {
+			got <- d
+			return NackRequeue
+		},
+		WithQueueOptions(WithDeliveryLimit(limit)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	// the first delivery and then one per return the limit allows
+	for range limit + 1 {
+		receive(t, got)
+	}
+	expectNone(t, got)
+
+	dls := deadLetters(t, conn)
+	if len(dls) != 1 {
+		t.Fatalf("dead-lettered %d messages, want 1", len(dls))
+	}
+	if dls[0].Reason != "delivery_limit" || dls[0].Queue != "pause.test" {
+		t.Errorf("dead-lettered from %s for %s", dls[0].Queue, dls[0].Reason)
+	}
+}
+
+// TestManagedConnResumesStream guards against re-attached stream consumers
+// starting again from the offset they first asked for.
+func TestManagedConnResumesStream(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBroker(t)
+	mc := newManagedTestConn(t, b)
+
+	got := make(chan Delivery[routing.PlayingState], 10)
+	sub, err := SubscribeDelivery(ctx, mc, routing.ExchangePerilTopic,
+		routing.QueueArmyMovesAudit,
+		routing.ArmyMovesPrefix+".*",
+		Stream,
+		func(d Delivery[routing.PlayingState]) AckType {
+			got <- d
+			return Ack
+		},
+		WithStreamOffset(StreamFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	publish := func(n int) {
+		t.Helper()
+		for range n {
+			testPublish(t, b.Connect(), routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", routing.PlayingState{})
+		}
+	}
+	publish(3)
+	for want := range int64(3) {
+		if d := receive(t, got); d.StreamOffset != want {
+			t.Errorf("got offset %d, want %d", d.StreamOffset, want)
+		}
+	}
+
+	// the consumer picks up after the last offset it handled, rather than
+	// starting from the first again
+	b.Restart()
+	publish(2)
+	for want := int64(3); want < 5; want++ {
+		if d := receive(t, got); d.StreamOffset != want {
+			t.Errorf("after the restart got offset %d, want %d", d.StreamOffset, want)
+		}
+	}
+	expectNone(t, got)
+}
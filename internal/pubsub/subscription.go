@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type SubscribeOption func(*SubscribeOptions)
+
+type SubscribeOptions struct {
+	// OnDecodeError handles deliveries that can not be decoded. Defaults to
+	// DeadLetterDecodeErrors.
+	OnDecodeError DecodeErrorPolicy
+	// Retry is applied when a handler returns RetryLater. Defaults to
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
+	// DefaultContentType picks the codec for deliveries that carry no
+	// ContentType. When empty routing.ContentType decides.
+	DefaultContentType string
+	// Workers is the number of handlers run concurrently. Defaults to one.
+	Workers int
+	// OrderBy, when set with several Workers, keeps messages with the same
+	// key in order.
+	OrderBy func(amqp.Delivery) string
+	// Middleware wraps decoding and the handler, the first one outermost.
+	Middleware []Middleware
+	// Queue is applied to routing's defaults for the subscription's queue
+	// when it is declared.
+	Queue []QueueOption
+	// StreamOffset is where a subscription to a Stream queue starts.
+	StreamOffset StreamOffset
+
+	// PrefetchCount is how many unacknowledged messages the broker sends
+	// ahead. Defaults to 10; 0 means no limit.
+	PrefetchCount int
+	// PrefetchSize limits unacknowledged messages by size in bytes. RabbitMQ
+	// only accepts 0, no limit.
+	PrefetchSize int
+	// ConsumerTag defaults to a random tag derived from the queue name.
+	ConsumerTag string
+	// Exclusive makes this the only consumer allowed on the queue.
+	Exclusive bool
+	// Priority is the consumer's x-priority. The broker delivers to the
+	// highest priority consumers that have room under their prefetch.
+	Priority int32
+	// AutoAck has the broker consider messages settled as soon as they are
+	// sent. Handler results other than RetryLater are then ignored, and
+	// messages that were in flight are lost if the subscriber dies.
+	AutoAck bool
+}
+
+func newSubscribeOptions(opts []SubscribeOption) SubscribeOptions {
+	o := SubscribeOptions{
+		OnDecodeError: DeadLetterDecodeErrors,
+		Retry:         DefaultRetryPolicy,
+		PrefetchCount: 10,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func WithDecodeErrorPolicy(policy DecodeErrorPolicy) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.OnDecodeError = policy
+	}
+}
+
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.PrefetchCount, o.PrefetchSize = count, size
+	}
+}
+
+func WithConsumerTag(tag string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.ConsumerTag = tag
+	}
+}
+
+func WithExclusiveConsumer() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Exclusive = true
+	}
+}
+
+func WithPriority(priority int32) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Priority = priority
+	}
+}
+
+func WithAutoAck() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.AutoAck = true
+	}
+}
+
+func WithDefaultContentType(contentType string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.DefaultContentType = contentType
+	}
+}
+
+// Subscription is a running consumer started by Subscribe. It is stopped
+// with Close or Drain, or when the context it was started with is cancelled.
+type Subscription struct {
+	ch   Channel
+	tag  string
+	stop chan struct{}
+	done chan struct{}
+
+	once sync.Once
+	err  error
+}
+
+func newSubscription(ch Channel, tag string) *Subscription {
+	return &Subscription{
+		ch:   ch,
+		tag:  tag,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Done is closed once the subscription has stopped handling messages.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close cancels the consumer and waits for the handlers that are currently
+// running, if any, to finish and settle their messages. Messages the broker had
+// already sent but that were not handled yet are requeued.
+func (s *Subscription) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		err := s.ch.Cancel(s.tag, false)
+		<-s.done
+		s.err = errors.Join(err, s.ch.Close())
+	})
+	return s.err
+}
+
+// Drain cancels the consumer and keeps handling the messages the broker had
+// already sent before closing the channel. If ctx ends first the remaining
+// messages are requeued as with Close.
+func (s *Subscription) Drain(ctx context.Context) error {
+	s.once.Do(func() {
+		err := s.ch.Cancel(s.tag, false)
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			close(s.stop)
+			<-s.done
+			err = errors.Join(err, ctx.Err())
+		}
+		s.err = errors.Join(err, s.ch.Close())
+	})
+	return s.err
+}
+
+func (s *Subscription) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.Close()
+	case <-s.done:
+	}
+}
+
+func consumerTag(queue string) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "peril-" + queue + "-" + hex.EncodeToString(b)
+}
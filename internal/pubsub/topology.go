@@ -0,0 +1,391 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology declares exchanges, queues and bindings. Its JSON form uses the
+// field names of RabbitMQ's definitions export, so a section of an export
+// can be pasted in.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+// QueueSpec declares a queue. Arguments hold x-dead-letter-exchange,
+// x-message-ttl, x-max-length, x-queue-type and the like.
+type QueueSpec struct {
+	Name       string     `json:"name"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Exclusive  bool       `json:"exclusive,omitempty"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+// BindingSpec binds a queue to an exchange. Only queue destinations are
+// supported.
+type BindingSpec struct {
+	Source          string     `json:"source"`
+	Destination     string     `json:"destination"`
+	DestinationType string     `json:"destination_type,omitempty"`
+	RoutingKey      string     `json:"routing_key"`
+	Arguments       amqp.Table `json:"arguments,omitempty"`
+}
+
+func (b BindingSpec) String() string {
+	return fmt.Sprintf("%s -> %s (%q)", b.Source, b.Destination, b.RoutingKey)
+}
+
+// LoadTopology parses and checks a topology definition.
+func LoadTopology(data []byte) (Topology, error) {
+	var t Topology
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return Topology{}, fmt.Errorf("could not parse topology: %w", err)
+	}
+	t.normalize()
+	if err := t.validate(); err != nil {
+		return Topology{}, fmt.Errorf("invalid topology: %w", err)
+	}
+	return t, nil
+}
+
+func (t Topology) validate() error {
+	var errs []error
+	for _, e := range t.Exchanges {
+		switch {
+		case e.Name == "":
+			errs = append(errs, errors.New("exchange without a name"))
+		case e.Type != amqp.ExchangeDirect && e.Type != amqp.ExchangeTopic &&
+			e.Type != amqp.ExchangeFanout && e.Type != amqp.ExchangeHeaders:
+			errs = append(errs, fmt.Errorf("exchange %s: unknown type %q", e.Name, e.Type))
+		}
+	}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			errs = append(errs, errors.New("queue without a name"))
+		}
+	}
+	for _, b := range t.Bindings {
+		switch {
+		case b.Source == "" || b.Destination == "":
+			errs = append(errs, fmt.Errorf("binding %s: needs a source and a destination", b))
+		case b.DestinationType != "queue":
+			errs = append(errs, fmt.Errorf("binding %s: unsupported destination type %q", b, b.DestinationType))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// normalize fills in defaults and gives arguments the integer types the
+// broker expects, whichever way they were decoded.
+func (t *Topology) normalize() {
+	for i := range t.Exchanges {
+		t.Exchanges[i].Arguments = normalizeArgs(t.Exchanges[i].Arguments)
+	}
+	for i := range t.Queues {
+		t.Queues[i].Arguments = normalizeArgs(t.Queues[i].Arguments)
+	}
+	for i := range t.Bindings {
+		if t.Bindings[i].DestinationType == "" {
+			t.Bindings[i].DestinationType = "queue"
+		}
+		t.Bindings[i].Arguments = normalizeArgs(t.Bindings[i].Arguments)
+	}
+}
+
+func normalizeArgs(args amqp.Table) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+	out := make(amqp.Table, len(args))
+	for k, v := range args {
+		out[k] = normalizeArg(v)
+	}
+	return out
+}
+
+func normalizeArg(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case map[string]any:
+		return map[string]any(normalizeArgs(v))
+	case amqp.Table:
+		return normalizeArgs(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalizeArg(e)
+		}
+		return out
+	}
+	return v
+}
+
+// ApplyTopology declares everything in t. Declaring what already exists
+// with the same settings does nothing, so it is safe to run on every
+// startup; an existing queue or exchange declared differently is an error
+// and has to be deleted by hand first.
+func ApplyTopology(ctx context.Context, conn Broker, t Topology) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %w", err)
+	}
+	defer ch.Close()
+
+	// a failed declare closes the channel, so stop at the first one
+	for _, e := range t.Exchanges {
+		err := ch.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, e.Arguments)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		err := ch.QueueBind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+		if err != nil {
+			return fmt.Errorf("could not bind %s: %w", b, err)
+		}
+	}
+	return nil
+}
+
+// PerilTopology loads routing.Topology. Queues with routing.QueueDefaults
+// get the arguments DeclareAndBind would declare them with, on top of those
+// in the file, so the two always agree.
+func PerilTopology() (Topology, error) {
+	t, err := LoadTopology(routing.Topology)
+	if err != nil {
+		return Topology{}, err
+	}
+	for i, q := range t.Queues {
+		if routing.QueueLimitsFor(q.Name) == (routing.QueueLimits{}) {
+			continue
+		}
+		args, err := queueArgs(specQueueType(q), newQueueOptions(q.Name, nil))
+		if err != nil {
+			return Topology{}, fmt.Errorf("queue %s: %w", q.Name, err)
+		}
+		for k, v := range q.Arguments {
+			if _, ok := args[k]; !ok {
+				args[k] = v
+			}
+		}
+		t.Queues[i].Arguments = args
+	}
+	return t, nil
+}
+
+func specQueueType(q QueueSpec) SimpleQueueType {
+	switch q.Arguments["x-queue-type"] {
+	case "quorum":
+		return Quorum
+	case "stream":
+		return Stream
+	}
+	if q.Durable {
+		return Durable
+	}
+	return Transient
+}
+
+// DeclarePerilTopology applies PerilTopology.
+func DeclarePerilTopology(ctx context.Context, conn Broker) error {
+	t, err := PerilTopology()
+	if err != nil {
+		return err
+	}
+	return ApplyTopology(ctx, conn, t)
+}
+
+// TopologyChange is one difference between a topology and a broker.
+type TopologyChange struct {
+	// Op is "+" for something the broker is missing, "~" for something it
+	// has declared differently and "-" for something only it has.
+	Op     string
+	Kind   string
+	Name   string
+	Detail string
+}
+
+func (c TopologyChange) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Op, c.Kind, c.Name)
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+// DiffTopology compares want with what a broker has, as read from its
+// management API. Exchanges and queues the broker has but want does not
+// mention are only reported if extra is set, since clients declare their
+// own; the default and amq.* exchanges are never reported.
+func DiffTopology(want, have Topology, extra bool) []TopologyChange {
+	want.normalize()
+	have.normalize()
+	var changes []TopologyChange
+
+	haveExchanges := map[string]ExchangeSpec{}
+	for _, e := range have.Exchanges {
+		haveExchanges[e.Name] = e
+	}
+	wantExchanges := map[string]bool{}
+	for _, e := range want.Exchanges {
+		wantExchanges[e.Name] = true
+		got, ok := haveExchanges[e.Name]
+		if !ok {
+			changes = append(changes, TopologyChange{Op: "+", Kind: "exchange", Name: e.Name, Detail: e.Type})
+			continue
+		}
+		if diff := fieldDiff(e, got); diff != "" {
+			changes = append(changes, TopologyChange{Op: "~", Kind: "exchange", Name: e.Name, Detail: diff})
+		}
+	}
+
+	haveQueues := map[string]QueueSpec{}
+	for _, q := range have.Queues {
+		haveQueues[q.Name] = q
+	}
+	wantQueues := map[string]bool{}
+	for _, q := range want.Queues {
+		wantQueues[q.Name] = true
+		got, ok := haveQueues[q.Name]
+		if !ok {
+			changes = append(changes, TopologyChange{Op: "+", Kind: "queue", Name: q.Name})
+			continue
+		}
+		if diff := fieldDiff(q, got); diff != "" {
+			changes = append(changes, TopologyChange{Op: "~", Kind: "queue", Name: q.Name, Detail: diff})
+		}
+	}
+
+	haveBindings := map[string]bool{}
+	for _, b := range have.Bindings {
+		haveBindings[b.String()] = true
+	}
+	wantBindings := map[string]bool{}
+	for _, b := range want.Bindings {
+		wantBindings[b.String()] = true
+		if !haveBindings[b.String()] {
+			changes = append(changes, TopologyChange{Op: "+", Kind: "binding", Name: b.String()})
+		}
+	}
+
+	if extra {
+		for _, e := range have.Exchanges {
+			if !wantExchanges[e.Name] && e.Name != "" && !strings.HasPrefix(e.Name, "amq.") {
+				changes = append(changes, TopologyChange{Op: "-", Kind: "exchange", Name: e.Name, Detail: e.Type})
+			}
+		}
+		for _, q := range have.Queues {
+			if !wantQueues[q.Name] {
+				changes = append(changes, TopologyChange{Op: "-", Kind: "queue", Name: q.Name})
+			}
+		}
+		for _, b := range have.Bindings {
+			if !wantBindings[b.String()] && b.Source != "" {
+				changes = append(changes, TopologyChange{Op: "-", Kind: "binding", Name: b.String()})
+			}
+		}
+	}
+	return changes
+}
+
+// fieldDiff describes how the exported fields of two specs of the same
+// type differ, or returns "" if they do not.
+func fieldDiff(want, have any) string {
+	wv, hv := reflect.ValueOf(want), reflect.ValueOf(have)
+	var diffs []string
+	for i := 0; i < wv.NumField(); i++ {
+		name := wv.Type().Field(i).Tag.Get("json")
+		name, _, _ = strings.Cut(name, ",")
+		w, h := wv.Field(i).Interface(), hv.Field(i).Interface()
+		if name == "arguments" {
+			diffs = append(diffs, argsDiff(w.(amqp.Table), h.(amqp.Table))...)
+			continue
+		}
+		if !reflect.DeepEqual(w, h) {
+			diffs = append(diffs, fmt.Sprintf("%s is %v, want %v", name, h, w))
+		}
+	}
+	return strings.Join(diffs, "; ")
+}
+
+func argsDiff(want, have amqp.Table) []string {
+	keys := map[string]bool{}
+	for k := range want {
+		keys[k] = true
+	}
+	for k := range have {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, k := range sorted {
+		w, wok := want[k]
+		h, hok := have[k]
+		// newer brokers report the queue type of every queue
+		if k == "x-queue-type" && (!wok && h == "classic" || !hok && w == "classic") {
+			continue
+		}
+		switch {
+		case !hok:
+			diffs = append(diffs, fmt.Sprintf("%s is unset, want %v", k, w))
+		case !wok:
+			diffs = append(diffs, fmt.Sprintf("%s is %v, want it unset", k, h))
+		case !reflect.DeepEqual(w, h):
+			diffs = append(diffs, fmt.Sprintf("%s is %v, want %v", k, h, w))
+		}
+	}
+	return diffs
+}
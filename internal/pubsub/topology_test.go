@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDiffTopology(t *testing.T) {
+	want := Topology{
+		Exchanges: []ExchangeSpec{{Name: "peril_topic", Type: "topic", Durable: true}},
+		Queues: []QueueSpec{{Name: "game_logs", Durable: true, Arguments: amqp.Table{
+			"x-queue-type":  "quorum",
+			"x-max-length":  10000,
+			"x-message-ttl": 60000,
+		}}},
+		Bindings: []BindingSpec{{Source: "peril_topic", Destination: "game_logs", RoutingKey: "game_logs.*"}},
+	}
+	// as the management API reports want
+	same := func() Topology {
+		return Topology{
+			Exchanges: []ExchangeSpec{
+				{Name: "", Type: "direct", Durable: true},
+				{Name: "amq.topic", Type: "topic", Durable: true},
+				{Name: "peril_topic", Type: "topic", Durable: true},
+			},
+			Queues: []QueueSpec{{Name: "game_logs", Durable: true, Arguments: amqp.Table{
+				"x-queue-type":  "quorum",
+				"x-max-length":  float64(10000),
+				"x-message-ttl": float64(60000),
+			}}},
+			Bindings: []BindingSpec{
+				{Source: "", Destination: "game_logs", DestinationType: "queue", RoutingKey: "game_logs"},
+				{Source: "peril_topic", Destination: "game_logs", DestinationType: "queue", RoutingKey: "game_logs.*"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		want  Topology
+		have  func(*Topology)
+		extra bool
+		diff  []string
+	}{
+		{"same", want, func(*Topology) {}, true, nil},
+		{
+			"missing",
+			want,
+			func(h *Topology) {
+				h.Exchanges = h.Exchanges[:2]
+				h.Queues = nil
+				h.Bindings = h.Bindings[:1]
+			},
+			false,
+			[]string{
+				"+ exchange peril_topic: topic",
+				"+ queue game_logs",
+				`+ binding peril_topic -> game_logs ("game_logs.*")`,
+			},
+		},
+		{
+			"different",
+			want,
+			func(h *Topology) {
+				h.Exchanges[2].Type = "direct"
+				delete(h.Queues[0].Arguments, "x-message-ttl")
+				h.Queues[0].Arguments["x-max-length"] = float64(500)
+				h.Queues[0].Arguments["x-overflow"] = "drop-head"
+			},
+			false,
+			[]string{
+				"~ exchange peril_topic: type is direct, want topic",
+				"~ queue game_logs: x-max-length is 500, want 10000; x-message-ttl is unset, want 60000; x-overflow is drop-head, want it unset",
+			},
+		},
+		{
+			"extra not reported",
+			want,
+			func(h *Topology) {
+				h.Queues = append(h.Queues, QueueSpec{Name: "pause.alice"})
+			},
+			false,
+			nil,
+		},
+		{
+			"extra",
+			want,
+			func(h *Topology) {
+				h.Exchanges = append(h.Exchanges, ExchangeSpec{Name: "peril_old", Type: "fanout"})
+				h.Queues = append(h.Queues, QueueSpec{Name: "pause.alice"})
+				h.Bindings = append(h.Bindings, BindingSpec{Source: "peril_topic", Destination: "pause.alice", RoutingKey: "pause"})
+			},
+			true,
+			[]string{
+				"- exchange peril_old: fanout",
+				"- queue pause.alice",
+				`- binding peril_topic -> pause.alice ("pause")`,
+			},
+		},
+		{
+			"classic is unset",
+			Topology{Queues: []QueueSpec{{Name: "peril_dlq", Durable: true}}},
+			func(h *Topology) {
+				h.Queues = []QueueSpec{{Name: "peril_dlq", Durable: true, Arguments: amqp.Table{"x-queue-type": "classic"}}}
+			},
+			false,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have := same()
+			tt.have(&have)
+			var diff []string
+			for _, c := range DiffTopology(tt.want, have, tt.extra) {
+				diff = append(diff, c.String())
+			}
+			if !slices.Equal(diff, tt.diff) {
+				t.Errorf("got changes\n%v\nwant\n%v", diff, tt.diff)
+			}
+		})
+	}
+}
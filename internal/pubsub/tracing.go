@@ -0,0 +1,99 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace context travels in AMQP headers using whatever propagator is
+// installed with otel.SetTextMapPropagator, normally W3C trace context.
+var tracer = otel.Tracer("github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub")
+
+// headerCarrier lets propagators read and write AMQP headers.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startPublish starts a producer span for msg and injects its context into
+// msg's headers. msg should already be stamped.
+func startPublish(ctx context.Context, exchange, key string, msg *amqp.Publishing) (context.Context, trace.Span) {
+	destination := exchange
+	if destination == "" {
+		destination = "amq.default"
+	}
+	ctx, span := tracer.Start(ctx, "publish "+destination,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(key),
+			semconv.MessagingMessageID(msg.MessageId),
+			semconv.MessagingMessageConversationID(msg.CorrelationId),
+			semconv.MessagingMessageBodySize(len(msg.Body)),
+		))
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Headers))
+	return ctx, span
+}
+
+// startProcess continues the trace msg was published in with a consumer
+// span for handling it.
+func startProcess(ctx context.Context, queue string, msg amqp.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Headers))
+	return tracer.Start(ctx, "process "+queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(queue),
+			semconv.MessagingRabbitmqDestinationRoutingKey(msg.RoutingKey),
+			semconv.MessagingMessageID(msg.MessageId),
+			semconv.MessagingMessageConversationID(msg.CorrelationId),
+			semconv.MessagingMessageBodySize(len(msg.Body)),
+		))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endProcess records how the message was settled on span and ends it.
+// Discarded messages mark the span as failed.
+func endProcess(span trace.Span, ack AckType) {
+	span.SetAttributes(attribute.String("peril.ack", ack.String()))
+	var err error
+	if ack == NackDiscard {
+		err = fmt.Errorf("message discarded")
+	}
+	endSpan(span, err)
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// WithWorkers runs n handlers concurrently, sharing the subscription's
+// prefetch. Without WithOrderingKey messages are handled in whatever order
+// the workers pick them up.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Workers = n
+	}
+}
+
+// WithOrderingKey keeps messages with the same key in the order they were
+// delivered by always handing them to the same worker, while messages with
+// different keys are handled in parallel.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.OrderBy = key
+	}
+}
+
+// RoutingKeySuffix is an ordering key: the part of the routing key after the
+// first dot, which is the username for most Peril messages.
+func RoutingKeySuffix(d amqp.Delivery) string {
+	_, suffix, _ := strings.Cut(d.RoutingKey, ".")
+	return suffix
+}
+
+// dispatch hands msgs to handle until msgs is closed or stop is. Messages
+// already dispatched but not handled when stop closes are left unsettled,
+// so they are requeued when the channel closes.
+func dispatch(stop <-chan struct{}, msgs <-chan amqp.Delivery, workers, buffer int, orderBy func(amqp.Delivery) string, handle func(amqp.Delivery)) {
+	if workers <= 1 {
+		work(stop, msgs, handle)
+		return
+	}
+
+	// without ordering the workers share one unbuffered queue; with it each
+	// worker gets its own, buffered so one busy key doesn't hold up the rest
+	queues := make([]chan amqp.Delivery, 1)
+	if orderBy != nil {
+		queues = make([]chan amqp.Delivery, workers)
+	} else {
+		buffer = 0
+	}
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery, buffer)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(queue <-chan amqp.Delivery) {
+			defer wg.Done()
+			work(stop, queue, handle)
+		}(queues[i%len(queues)])
+	}
+	defer wg.Wait()
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+
+	for {
+		var msg amqp.Delivery
+		var ok bool
+		select {
+		case <-stop:
+			return
+		case msg, ok = <-msgs:
+			if !ok {
+				return
+			}
+		}
+
+		queue := queues[0]
+		if orderBy != nil {
+			h := fnv.New32a()
+			h.Write([]byte(orderBy(msg)))
+			queue = queues[h.Sum32()%uint32(len(queues))]
+		}
+		select {
+		case <-stop:
+			return
+		case queue <- msg:
+		}
+	}
+}
+
+func work(stop <-chan struct{}, msgs <-chan amqp.Delivery, handle func(amqp.Delivery)) {
+	for {
+		var msg amqp.Delivery
+		var ok bool
+		select {
+		case <-stop:
+			return
+		case msg, ok = <-msgs:
+			if !ok {
+				return
+			}
+		}
+		handle(msg)
+	}
+}
@@ -0,0 +1,150 @@
+package pubsub
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestWorkersParallel(t *testing.T) {
+	const workers = 4
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+
+	started := make(chan struct{}, workers)
+	release := make(chan struct{})
+	sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType {
+			started <- struct{}{}
+			<-release
+			return Ack
+		},
+		WithWorkers(workers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	defer close(release)
+
+	for range workers {
+		testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{})
+	}
+	// every message is being handled before any of them finishes
+	for range workers {
+		receive(t, started)
+	}
+}
+
+func TestWorkersOrdering(t *testing.T) {
+	const perPlayer = 50
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+	players := []string{"alice", "bob", "carol"}
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	done := make(chan struct{}, len(players)*perPlayer)
+	sub, err := Subscribe(ctx, conn, routing.ExchangePerilTopic, "test.ordering", routing.GameLogSlug+".*", Durable,
+		func(gl routing.GameLog) AckType {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			n, _ := strconv.Atoi(gl.Message)
+			mu.Lock()
+			got[gl.Username] = append(got[gl.Username], n)
+			mu.Unlock()
+			done <- struct{}{}
+			return Ack
+		},
+		WithWorkers(4),
+		WithOrderingKey(RoutingKeySuffix),
+		WithPrefetch(20, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for i := range perPlayer {
+		for _, p := range players {
+			err := Publish(ctx, ch, routing.ExchangePerilTopic, routing.GameLogSlug+"."+p, routing.GameLog{
+				Username: p,
+				Message:  strconv.Itoa(i),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for range len(players) * perPlayer {
+		receive(t, done)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range players {
+		for i, n := range got[p] {
+			if n != i {
+				t.Fatalf("%s's messages handled in order %v", p, got[p])
+			}
+		}
+	}
+}
+
+func TestWorkersDecodeError(t *testing.T) {
+	ctx := context.Background()
+	_, conn := newTestBroker(t)
+
+	got := make(chan routing.PlayingState, 10)
+	sub, err := Subscribe(ctx, conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, Durable,
+		func(ps routing.PlayingState) AckType {
+			got <- ps
+			return Ack
+		},
+		WithWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for range 4 {
+		err := ch.PublishWithContext(ctx, routing.ExchangePerilDirect, routing.PauseKey, false, false, amqp.Publishing{
+			ContentType: "application/json",
+			Body:        []byte("not json"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPublish(t, conn, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true})
+	}
+	for range 4 {
+		if ps := receive(t, got); !ps.IsPaused {
+			t.Errorf("got %+v", ps)
+		}
+	}
+	expectNone(t, got)
+
+	dls := deadLetters(t, conn)
+	if len(dls) != 4 {
+		t.Fatalf("dead-lettered %d messages, want 4", len(dls))
+	}
+	for _, dl := range dls {
+		if !strings.HasPrefix(dl.Reason, "decode error: ") || dl.Queue != "pause.test" {
+			t.Errorf("dead-lettered from %s: %s", dl.Queue, dl.Reason)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package routing
+
+import "strings"
+
+// Encodings picks the content type messages are published with, by routing
+// key prefix. Subscribers decode by the content type each message carries,
+// so an entry can be switched to any codec registered with pubsub without
+// touching either side.
+var Encodings = map[string]string{
+	PauseKey:              "application/json",
+	ArmyMovesPrefix:       "application/json",
+	WarRecognitionsPrefix: "application/json",
+	GameLogSlug:           "application/gob",
+	PresencePrefix:        "application/json",
+	RPCPrefix:             "application/json",
+}
+
+// ContentType returns the content type configured for the prefix of key, or
+// "" if there is none.
+func ContentType(key string) string {
+	prefix, _, _ := strings.Cut(key, ".")
+	return Encodings[prefix]
+}
@@ -11,3 +11,19 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+// Presence is published by clients when they join and leave, and
+// periodically in between, see PresenceInterval.
+type Presence struct {
+	Username string
+	Online   bool
+}
+
+// PresenceInterval is how often clients announce they are still online.
+const PresenceInterval = 30 * time.Second
+
+type OnlinePlayersRequest struct{}
+
+type OnlinePlayersResponse struct {
+	Players []string
+}
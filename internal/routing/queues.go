@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"strings"
+	"time"
+)
+
+// What a full queue does with more messages, see QueueLimits.Overflow.
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// QueueLimits bound how long messages wait in a queue and how many can pile
+// up. Zero fields leave the broker's default, which is no limit.
+type QueueLimits struct {
+	// MessageTTL dead-letters messages that have waited this long.
+	MessageTTL time.Duration
+	// Expires deletes the queue once it has had no consumers for this long.
+	Expires time.Duration
+	// MaxLength and MaxLengthBytes cap the messages waiting in the queue.
+	// Streams only take MaxLengthBytes, which bounds what they retain.
+	MaxLength      int
+	MaxLengthBytes int
+	// Overflow is what a full queue does: OverflowDropHead, the default,
+	// dead-letters its oldest messages; OverflowRejectPublish refuses new
+	// ones, which publishers see as a nack; OverflowRejectPublishDLX also
+	// dead-letters them. Quorum queues do not support the last.
+	Overflow string
+	// DeliveryLimit is how many times a quorum queue redelivers a message
+	// before dead-lettering it.
+	DeliveryLimit int
+}
+
+// QueueDefaults are the limits queues are declared with, by the prefix of
+// their name, including the shared queues declared from topology.json.
+var QueueDefaults = map[string]QueueLimits{
+	// a backlog of moves is only useful to the player it was meant for,
+	// and their queue goes when they do
+	ArmyMovesPrefix: {MaxLength: 10_000},
+	// wars and logs must not be lost, so a flood is refused at the door
+	WarRecognitionsPrefix: {
+		MaxLength:     10_000,
+		Overflow:      OverflowRejectPublish,
+		DeliveryLimit: 10,
+	},
+	GameLogSlug: {
+		MaxLength:      100_000,
+		MaxLengthBytes: 64 << 20,
+		Overflow:       OverflowRejectPublish,
+		DeliveryLimit:  10,
+	},
+	// presence and requests are stale once their sender has given up
+	PresencePrefix:      {MessageTTL: PresenceInterval},
+	RPCPrefix:           {MessageTTL: 10 * time.Second},
+	QueueArmyMovesAudit: {MaxLengthBytes: 1 << 30},
+}
+
+// QueueLimitsFor returns the defaults for the prefix of queue.
+func QueueLimitsFor(queue string) QueueLimits {
+	prefix, _, _ := strings.Cut(queue, ".")
+	return QueueDefaults[prefix]
+}
@@ -8,9 +8,23 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	PresencePrefix = "presence"
+
+	RPCPrefix        = "rpc"
+	OnlinePlayersKey = RPCPrefix + ".online_players"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+const (
+	QueuePerilDLQ = "peril_dlq"
+
+	// QueueArmyMovesAudit is a stream of every army move, for reading back
+	// from any point.
+	QueueArmyMovesAudit = "army_moves_audit"
 )
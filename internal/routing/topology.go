@@ -0,0 +1,12 @@
+package routing
+
+import _ "embed"
+
+// Topology describes the exchanges, shared queues and bindings Peril
+// expects, in the format read by pubsub.LoadTopology. Per-player queues are
+// declared by the clients as they subscribe. The arguments of queues with
+// QueueDefaults are filled in from them by pubsub.PerilTopology, so they are
+// left out here.
+//
+//go:embed topology.json
+var Topology []byte
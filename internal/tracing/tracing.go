@@ -0,0 +1,69 @@
+// Package tracing configures OpenTelemetry for the Peril binaries. Trace
+// context is always propagated through AMQP headers, so a trace survives
+// passing through a process that does not export spans itself.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+type Config struct {
+	// Output is a file spans are appended to as JSON, "-" for stdout, or ""
+	// to not export them.
+	Output string
+}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Output, "traces", "", "append trace spans as JSON to this file, or - for stdout")
+}
+
+// Setup installs the W3C trace context propagator and, if Output is set, a
+// tracer provider exporting spans there on behalf of service. The returned
+// function flushes any spans not yet exported.
+func (c Config) Setup(service string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if c.Output == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var w io.WriteCloser = nopCloser{os.Stdout}
+	if c.Output != "-" {
+		f, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open trace output: %w", err)
+		}
+		w = f
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		return errors.Join(tp.Shutdown(ctx), w.Close())
+	}, nil
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }